@@ -0,0 +1,51 @@
+package fnet
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+)
+
+// Reserved event id for messages with a checksum
+// The payload is a wire message followed by the little endian crc32 (IEEE) checksum of it
+const EvtChecksum int32 = -7
+
+// Wraps the wire message with a checksum if Engine.Checksum is set and the peer supports it
+func (e *Engine) addChecksum(session Session, wireMessage []byte) ([]byte, error) {
+	if !e.Checksum || !session.Supports(FeatureChecksum) {
+		return wireMessage, nil
+	}
+
+	payload := make([]byte, len(wireMessage)+4)
+	copy(payload, wireMessage)
+	binary.LittleEndian.PutUint32(payload[len(wireMessage):], crc32.ChecksumIEEE(wireMessage))
+	return e.createWireMessage(EvtChecksum, payload)
+}
+
+// Verifies the checksum of a EvtChecksum payload and returns the wrapped message
+func (e *Engine) verifyChecksum(payload []byte) (frame, error) {
+	if len(payload) < 4 {
+		atomic.AddUint64(e.checksumErrors, 1)
+		return frame{}, ErrChecksumMismatch
+	}
+
+	wireMessage := payload[:len(payload)-4]
+	if crc32.ChecksumIEEE(wireMessage) != binary.LittleEndian.Uint32(payload[len(wireMessage):]) {
+		atomic.AddUint64(e.checksumErrors, 1)
+		return frame{}, ErrChecksumMismatch
+	}
+
+	inner, err := e.parseFrame(wireMessage)
+	if err != nil {
+		return frame{}, err
+	}
+	if inner.evtId == EvtChecksum {
+		return frame{}, ErrMalformedMessage
+	}
+	return inner, nil
+}
+
+// Returns the number of messages received with a invalid checksum
+func (e *Engine) ChecksumErrors() uint64 {
+	return atomic.LoadUint64(e.checksumErrors)
+}
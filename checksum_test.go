@@ -0,0 +1,46 @@
+package fnet
+
+import (
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	srv, cli := newEngines()
+	cli.Checksum = true
+	received := make(chan testMsg, 3)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	wireMessage, err := cli.CreateWireMessage(1, testMsg{Text: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := cli.addChecksum(cs, wireMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := cli.parseFrame(valid); err != nil || f.evtId != EvtChecksum {
+		t.Fatal("message wasn't wrapped with a checksum")
+	}
+
+	// The last byte of the wrapped message, right before the checksum
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-5] ^= 0xff
+	cs.Conn.Send(corrupted)
+	cs.Conn.Send(valid)
+	if err := cli.CreateAndSend(cs, 1, testMsg{Text: "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The corrupted message is dropped without closing the connection
+	for _, text := range []string{"a", "b"} {
+		if msg := receive(t, received); msg.Text != text {
+			t.Fatalf("got %q, expected %q", msg.Text, text)
+		}
+	}
+	if n := srv.ChecksumErrors(); n != 1 {
+		t.Fatalf("%d checksum errors, expected 1", n)
+	}
+}
@@ -0,0 +1,229 @@
+package fnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reserved event id used to close a session
+// The payload is the CloseCode as a little endian uint16 followed by the reason
+const EvtClose int32 = -11
+
+// How long Session.Close waits for queued messages to be written by default
+const DefaultCloseTimeout = 5 * time.Second
+
+// Why a session was closed, the values are the same as the websocket close codes
+// Applications can use codes from 4000 and up
+type CloseCode uint16
+
+const (
+	CloseNormal          CloseCode = 1000
+	CloseGoingAway       CloseCode = 1001 // The server is shutting down
+	CloseProtocolError   CloseCode = 1002
+	CloseAbnormal        CloseCode = 1006 // The connection was closed without a close message, never sent
+	ClosePolicyViolation CloseCode = 1008 // E.g. kicked by an admin
+	CloseInternalError   CloseCode = 1011
+)
+
+// What caused a session to close
+type CloseCause int
+
+const (
+	CauseLocalClose       CloseCause = iota // Session.Close or Connection.Close was called
+	CauseRemoteClose                        // The peer sent a close message
+	CauseEOF                                // The peer closed the connection without a close message
+	CauseReadError                          // Reading from the connection failed
+	CauseWriteError                         // Writing to the connection failed
+	CauseSendTimeout                        // The connection's send queue stayed full for too long
+	CauseProtocolError                      // The peer sent something invalid
+	CauseHeartbeatTimeout                   // The peer stopped responding to pings
+	CauseHandlerPanic                       // A handler panicked and Engine.PanicPolicy is PanicCloseSession
+)
+
+var closeCauseNames = []string{
+	"local close",
+	"remote close",
+	"eof",
+	"read error",
+	"write error",
+	"send timeout",
+	"protocol error",
+	"heartbeat timeout",
+	"handler panic",
+}
+
+func (c CloseCause) String() string {
+	if c < 0 || int(c) >= len(closeCauseNames) {
+		return fmt.Sprintf("CloseCause(%d)", int(c))
+	}
+	return closeCauseNames[c]
+}
+
+// Passed to Engine.OnConnClose
+type CloseInfo struct {
+	Cause  CloseCause
+	Code   CloseCode
+	Reason string
+	Err    error // The error that closed the connection if it wasn't closed with a close message
+}
+
+// Optionally implemented by connections that queue messages passed to Send
+type Flusher interface {
+	// Blocks until everything passed to Send before calling Flush was written
+	Flush() error
+}
+
+// Optionally implemented by connections that close themselves when writing fails
+type CloseReporter interface {
+	// Returns why the connection closed itself, a *WriteError or ErrSendTimeout
+	// nil if it's open or Close was called
+	CloseError() error
+}
+
+// Reported by connections when writing to the underlying connection failed
+type WriteError struct {
+	Err error
+}
+
+func (w *WriteError) Error() string {
+	return "Write failed: " + w.Err.Error()
+}
+
+// Returned by handleClose to stop reading from the session
+var errClosedByPeer = errors.New("Closed by peer")
+
+// Sends a close message to the peer, waits for queued messages to be written and closes the connection
+// Returns ErrConnClosed if the session was already closed
+// Sessions not handled by an engine yet are closed without a close message, the code and reason are still passed to OnConnClose
+// Sessions still waiting for the peer's hello are closed without one aswell
+func (s Session) Close(code CloseCode, reason string) error {
+	info := CloseInfo{Cause: CauseLocalClose, Code: code, Reason: reason}
+	if s.state == nil {
+		s.Conn.Close()
+		return nil
+	}
+
+	engine := s.state.getEngine()
+	if engine == nil {
+		if !s.state.setClose(info) {
+			return ErrConnClosed
+		}
+		s.Conn.Close()
+		return nil
+	}
+	return engine.closeSession(s, info)
+}
+
+// Sends a close message with the code and reason in info, info is passed to OnConnClose
+func (e *Engine) closeSession(session Session, info CloseInfo) error {
+	if !session.state.setClose(info) {
+		return ErrConnClosed
+	}
+	defer session.Conn.Close()
+
+	if e.Handshake != nil {
+		select {
+		case <-session.state.ready:
+		default:
+			// Still waiting for the peer's hello, which might never come, and the peer wouldn't expect a close message yet
+			return nil
+		}
+	}
+
+	payload := make([]byte, 2, 2+len(info.Reason))
+	binary.LittleEndian.PutUint16(payload, uint16(info.Code))
+	payload = append(payload, info.Reason...)
+
+	wireMessage, err := e.createWireMessage(EvtClose, payload)
+	if err != nil {
+		return err
+	}
+
+	// The close message would be written before messages with a lower priority, so those are written first
+	err = e.flush(session)
+	if err != nil {
+		return err
+	}
+	err = e.sendPriority(session, wireMessage, PriorityControl)
+	if err != nil {
+		return err
+	}
+
+	err = e.flush(session)
+	if err == ErrConnClosed {
+		// The peer closes the connection after receiving the close message, that can happen before the flush returns
+		return nil
+	}
+	return err
+}
+
+// Waits for the messages queued on the session's connection to be written, if it supports it
+func (e *Engine) flush(session Session) error {
+	flusher, ok := session.Conn.(Flusher)
+	if !ok {
+		return nil
+	}
+
+	timeout := e.CloseTimeout
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- flusher.Flush()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return ErrTimeout
+	}
+}
+
+func (e *Engine) handleClose(payload []byte, session Session) error {
+	if len(payload) < 2 {
+		return ErrMalformedMessage
+	}
+
+	session.state.setClose(CloseInfo{
+		Cause:  CauseRemoteClose,
+		Code:   CloseCode(binary.LittleEndian.Uint16(payload)),
+		Reason: string(payload[2:]),
+	})
+	return errClosedByPeer
+}
+
+// Works out why the connection closed after reading from it failed with err
+func (e *Engine) abnormalClose(session Session, err error) CloseInfo {
+	info := CloseInfo{Code: CloseAbnormal, Err: err}
+
+	// The connection closing itself makes reading fail aswell, so that's checked first
+	if reporter, ok := session.Conn.(CloseReporter); ok {
+		if connErr := reporter.CloseError(); connErr != nil {
+			info.Err = connErr
+			if connErr == ErrSendTimeout {
+				info.Cause = CauseSendTimeout
+			} else {
+				info.Cause = CauseWriteError
+			}
+			return info
+		}
+	}
+
+	switch {
+	case !session.Conn.Open():
+		info.Cause = CauseLocalClose
+	case session.state.readErr == nil:
+		info.Cause = CauseProtocolError
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		info.Cause = CauseEOF
+	default:
+		info.Cause = CauseReadError
+	}
+	return info
+}
@@ -0,0 +1,130 @@
+package fnet
+
+import (
+	"errors"
+	"testing"
+)
+
+// Returns a channel receiving the CloseInfo of every session e closes
+func closeInfos(e *Engine) chan CloseInfo {
+	infos := make(chan CloseInfo, 1)
+	e.OnConnClose = func(session Session, info CloseInfo) {
+		infos <- info
+	}
+	return infos
+}
+
+func TestCloseCause(t *testing.T) {
+	t.Run("Close", func(t *testing.T) {
+		srv, cli := newEngines()
+		srvInfos, cliInfos := closeInfos(srv), closeInfos(cli)
+		opened := make(chan bool, 1)
+		cli.OnConnOpen = func(session Session) {
+			opened <- true
+		}
+		a, b := newPipe()
+		serve(t, srv, a)
+		cs := serve(t, cli, syncConn{b})
+
+		receive(t, opened)
+		if err := cs.Close(CloseGoingAway, "bye"); err != nil {
+			t.Fatal(err)
+		}
+		if info := receive(t, cliInfos); info != (CloseInfo{Cause: CauseLocalClose, Code: CloseGoingAway, Reason: "bye"}) {
+			t.Fatalf("local: got %+v", info)
+		}
+		if info := receive(t, srvInfos); info != (CloseInfo{Cause: CauseRemoteClose, Code: CloseGoingAway, Reason: "bye"}) {
+			t.Fatalf("remote: got %+v", info)
+		}
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		srv, cli := newEngines()
+		srvInfos, cliInfos := closeInfos(srv), closeInfos(cli)
+		_, cs := connect(t, srv, cli)
+
+		// Closed without a close message
+		cs.Conn.Close()
+		if info := receive(t, cliInfos); info.Cause != CauseLocalClose {
+			t.Fatalf("local: got %v", info.Cause)
+		}
+		if info := receive(t, srvInfos); info.Cause != CauseEOF || info.Code != CloseAbnormal {
+			t.Fatalf("remote: got %v %d", info.Cause, info.Code)
+		}
+	})
+
+	t.Run("ProtocolError", func(t *testing.T) {
+		srv, cli := newEngines()
+		srv.MaxPayloadSize = 16
+		srvInfos, cliInfos := closeInfos(srv), closeInfos(cli)
+		a, b := newPipe()
+		serve(t, srv, syncConn{a})
+		cs := serve(t, cli, b)
+
+		if err := cli.CreateAndSend(cs, 1, testMsg{Text: "longer than the max payload size"}); err != nil {
+			t.Fatal(err)
+		}
+		if info := receive(t, srvInfos); info.Cause != CauseProtocolError || info.Code != CloseProtocolError || info.Err != ErrPayloadTooLarge {
+			t.Fatalf("local: got %+v", info)
+		}
+		// The peer is told why
+		expected := CloseInfo{Cause: CauseRemoteClose, Code: CloseProtocolError, Reason: ErrPayloadTooLarge.Error()}
+		if info := receive(t, cliInfos); info != expected {
+			t.Fatalf("remote: got %+v", info)
+		}
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		srv := DefaultEngine()
+		srvInfos := closeInfos(srv)
+		a, b := newPipe()
+		conn := &reportingConn{pipeConn: a}
+		serve(t, srv, conn)
+		t.Cleanup(b.Close)
+
+		writeErr := &WriteError{Err: errors.New("Broken pipe")}
+		conn.closeWithError(writeErr)
+		if info := receive(t, srvInfos); info.Cause != CauseWriteError || info.Err != writeErr {
+			t.Fatalf("got %v %v", info.Cause, info.Err)
+		}
+	})
+}
+
+// Reports the error it was closed with like the tcp and ws connections do
+type reportingConn struct {
+	*pipeConn
+	err error
+}
+
+func (r *reportingConn) closeWithError(err error) {
+	r.err = err
+	r.Close()
+}
+
+func (r *reportingConn) CloseError() error {
+	return r.err
+}
+
+// Writes sent messages before returning, so the close message is written before Session.Close closes the connection
+type syncConn struct {
+	*pipeConn
+}
+
+func (s syncConn) Send(b []byte) error {
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// Handles conn with e, returns the session
+func serve(t testing.TB, e *Engine, conn Connection) Session {
+	go e.ListenChannels()
+	go func() {
+		for range e.ErrChan {
+		}
+	}()
+
+	session := NewSession(conn)
+	go e.HandleConn(session)
+	t.Cleanup(conn.Close)
+	return session
+}
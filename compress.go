@@ -0,0 +1,137 @@
+package fnet
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Reserved event id for compressed messages, the payload is a compressed wire message
+const EvtCompressed int32 = -6
+
+// Messages smaller than this are not compressed by DefaultEngine
+const DefaultCompressThreshold = 1024
+
+// A compression algorithm
+type Compressor interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Compression algorithms that can be negotiated in the handshake, their names as keys
+var (
+	compressors = map[string]Compressor{
+		"flate": FlateCompressor{Level: flate.DefaultCompression},
+		"gzip":  GzipCompressor{Level: gzip.DefaultCompression},
+	}
+	compressorsLock sync.RWMutex
+)
+
+// Registers a compression algorithm under name so it can be negotiated in the handshake
+func RegisterCompressor(name string, compressor Compressor) {
+	compressorsLock.Lock()
+	compressors[name] = compressor
+	compressorsLock.Unlock()
+}
+
+// Returns the compression algorithm registered under name
+func GetCompressor(name string) (compressor Compressor, found bool) {
+	compressorsLock.RLock()
+	compressor, found = compressors[name]
+	compressorsLock.RUnlock()
+	return
+}
+
+// Deflate compression from compress/flate
+type FlateCompressor struct {
+	Level int
+}
+
+func (f FlateCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, f.Level)
+}
+
+func (f FlateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+// Gzip compression from compress/gzip
+type GzipCompressor struct {
+	Level int
+}
+
+func (g GzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, g.Level)
+}
+
+func (g GzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// Compresses the wire message if compression was negotiated with session and it's big enough
+func (e *Engine) compress(session Session, wireMessage []byte) ([]byte, error) {
+	if session.state == nil || session.state.compressor == nil || len(wireMessage) < e.CompressThreshold {
+		return wireMessage, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := session.state.compressor.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(wireMessage)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Not worth it
+	if buf.Len() >= len(wireMessage) {
+		return wireMessage, nil
+	}
+	return e.createWireMessage(EvtCompressed, buf.Bytes())
+}
+
+// Decompresses the wrapped message and handles it
+func (e *Engine) handleCompressed(payload []byte, session Session) error {
+	if session.state == nil || session.state.compressor == nil {
+		return ErrNotSupported
+	}
+
+	r, err := session.state.compressor.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Don't let a small payload decompress into something huge
+	limit := int64(maxHeaderSize) + int64(e.maxPayloadSize(EvtCompressed))
+	if e.maxPayloadSize(EvtCompressed) <= 0 {
+		limit = 1<<31 - 1
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(decompressed)) > limit {
+		return ErrPayloadTooLarge
+	}
+
+	inner, err := e.parseFrame(decompressed)
+	if err != nil {
+		return err
+	}
+	if inner.evtId == EvtCompressed {
+		return ErrMalformedMessage
+	}
+	if max := e.maxPayloadSize(inner.evtId); max > 0 && int32(len(inner.payload)) > max {
+		return ErrPayloadTooLarge
+	}
+	return e.handleMessage(inner.evtId, inner.payload, session)
+}
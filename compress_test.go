@@ -0,0 +1,75 @@
+package fnet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	for _, algorithm := range []string{"flate", "gzip"} {
+		srv, cli := newEngines()
+		srv.Handshake = &Handshake{Hello: Hello{Compression: []string{algorithm}}}
+		cli.Handshake = &Handshake{Hello: Hello{Compression: []string{"gzip", "flate"}}}
+		cli.CompressThreshold = 64
+		received := make(chan testMsg, 1)
+		srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+			received <- msg
+		}, 1))
+
+		_, cs, negotiated, _ := handshake(t, srv, cli)
+		if negotiated.Compression != algorithm {
+			t.Fatalf("negotiated %q, expected %q", negotiated.Compression, algorithm)
+		}
+
+		for _, msg := range []testMsg{{Text: "small"}, {Text: strings.Repeat("compressible ", 100)}} {
+			wireMessage, err := cli.CreateWireMessage(1, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := cli.compress(cs, wireMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			small := len(wireMessage) < cli.CompressThreshold
+			if small != bytes.Equal(compressed, wireMessage) {
+				t.Errorf("%s: message of %d bytes compressed to %d bytes", algorithm, len(wireMessage), len(compressed))
+			}
+
+			if err := cli.CreateAndSend(cs, 1, msg); err != nil {
+				t.Fatal(err)
+			}
+			if got := receive(t, received); got != msg {
+				t.Errorf("%s: got %q", algorithm, got.Text)
+			}
+		}
+	}
+}
+
+func TestCompressionLimit(t *testing.T) {
+	e := DefaultEngine()
+	e.MaxPayloadSize = 1024
+	e.CompressThreshold = 0
+	session := NewSession(nil)
+	session.state.compressor, _ = GetCompressor("gzip")
+
+	// Compresses to a lot less than the limit, but decompresses to more
+	wireMessage, err := e.createWireMessage(1, make([]byte, 2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := e.compress(session, wireMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := e.parseFrame(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.evtId != EvtCompressed || len(f.payload) > 1024 {
+		t.Fatalf("event %d with %d bytes", f.evtId, len(f.payload))
+	}
+	if err := e.handleCompressed(f.payload, session); err != ErrPayloadTooLarge {
+		t.Fatalf("got %v, expected ErrPayloadTooLarge", err)
+	}
+}
@@ -1,71 +1,228 @@
-package fnet
-
-import (
-	"sync"
-)
-
-type Connection interface {
-	Send([]byte) error // Sends some data
-	Read([]byte) error // reads data into supplied byte slice
-	Kind() string      // What kind of connection is it (websocket, tcp etc..)
-	Close()            // Closes the connections ands stops all goroutines associated with it
-	Run()              // Starts the writer and reader goroutines
-	Open() bool        // Wether this connection is open ot not
-	IP() string
-}
-
-type Session struct {
-	Data *SessionStore
-	Conn Connection
-}
-
-type SessionStore struct {
-	Data  map[string]interface{}
-	Mutex sync.RWMutex
-}
-
-func (s *SessionStore) Set(key string, val interface{}) {
-	s.Mutex.Lock()
-	if s.Data == nil {
-		s.Data = make(map[string]interface{})
-	}
-	s.Data[key] = val
-	s.Mutex.Unlock()
-}
-
-func (s *SessionStore) Get(key string) (val interface{}, exists bool) {
-	s.Mutex.RLock()
-	if s.Data == nil {
-		s.Data = make(map[string]interface{})
-	}
-
-	value, exists := s.Data[key]
-	s.Mutex.RUnlock()
-	return value, exists
-}
-
-func (s *SessionStore) GetString(key string) (val string, exists bool) {
-	value, exists := s.Get(key)
-	if !exists {
-		return "", false
-	}
-
-	str := value.(string)
-	return str, true
-}
-
-func (s *SessionStore) GetBool(key string) (val bool, exists bool) {
-	raw, exists := s.Get(key)
-	if exists {
-		val, _ = raw.(bool)
-	}
-	return
-}
-
-func (s *SessionStore) GetInt(key string) (val int, exists bool) {
-	raw, exists := s.Get(key)
-	if exists {
-		val, _ = raw.(int)
-	}
-	return
-}
+package fnet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Connection interface {
+	Send([]byte) error // Sends some data
+	Read([]byte) error // reads data into supplied byte slice
+	Kind() string      // What kind of connection is it (websocket, tcp etc..)
+	Close()            // Closes the connections ands stops all goroutines associated with it
+	Run()              // Starts the writer and reader goroutines
+	Open() bool        // Wether this connection is open ot not
+	IP() string
+}
+
+type Session struct {
+	Data *SessionStore
+	Conn Connection
+
+	state *sessionState
+}
+
+// Per session state managed by the engine
+type sessionState struct {
+	ready       chan struct{} // Closed when the handshake is done
+	done        chan struct{} // Closed when the session is closed
+	negotiated  *Negotiated   // nil if no handshake was exchanged
+	encoder     Encoder       // The negotiated encoder, nil to use Engine.Encoder
+	encoderName string
+	compressor  Compressor // The negotiated compression algorithm, nil for none
+
+	// Only used by the reading goroutine
+	readErr       error                      // The error returned by Connection.Read, if it failed
+	header        [maxHeaderSize]byte        // Buffer for reading headers
+	streams       map[uint32]*fragmentStream // Fragmented messages being received
+	reassembling  int                        // Number of bytes buffered in streams
+	unknownEvents int                        // Number of messages received for events without a handler
+	received      time.Time                  // When the last frame was read
+	extra         []byte                     // Header.Extra of the last frame
+
+	rtt         int64 // Smoothed round trip time in nanoseconds, accessed atomically
+	missedPings int32 // Pings sent since the last pong, accessed atomically
+	handling    int32 // 1 while the reading goroutine handles a message and can't read pongs, accessed atomically
+
+	engine    *Engine    // The engine handling the session, set by Engine.HandleConn
+	jobs      *jobQueue  // Messages waiting to be handled with DispatchPool
+	closeLock sync.Mutex // Guards engine and closeInfo
+	closeInfo *CloseInfo // Why the session was closed, nil while it's open
+
+	ctx          context.Context // Passed to handlers taking one, cancelled when the session closes
+	cancel       context.CancelFunc
+	requests     map[uint32]context.CancelFunc // Cancels the contexts of requests being handled, request id's as keys
+	requestsLock sync.Mutex
+}
+
+// Sets why the session was closed, returns false if that was already set
+func (s *sessionState) setClose(info CloseInfo) bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closeInfo != nil {
+		return false
+	}
+	s.closeInfo = &info
+	// Handlers can stop right away instead of when the connection is closed
+	s.cancel()
+	return true
+}
+
+// Sets the engine handling the session, Session.Close can be called from other goroutines meanwhile
+func (s *sessionState) setEngine(e *Engine) {
+	s.closeLock.Lock()
+	s.engine = e
+	s.closeLock.Unlock()
+}
+
+func (s *sessionState) getEngine() *Engine {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.engine
+}
+
+func (s *sessionState) getClose() *CloseInfo {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.closeInfo
+}
+
+// Describes the message being handled, only called by the reading goroutine
+func (s *sessionState) envelope(evtId int32, size int) *Message {
+	return &Message{
+		Event:    evtId,
+		Size:     size,
+		Received: s.received,
+		Extra:    s.extra,
+	}
+}
+
+// The negotiated settings that affect how messages are encoded
+type sessionFormat struct {
+	encoder     string
+	compression string
+	features    Features
+}
+
+func (s *sessionState) format() sessionFormat {
+	format := sessionFormat{encoder: s.encoderName, features: AllFeatures}
+	if s.negotiated != nil {
+		format.compression = s.negotiated.Compression
+		format.features = s.negotiated.Features
+	}
+	return format
+}
+
+func newSessionState() *sessionState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sessionState{
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+		jobs:     newJobQueue(),
+		ctx:      ctx,
+		cancel:   cancel,
+		requests: make(map[uint32]context.CancelFunc),
+	}
+}
+
+// Creates a new session for conn, sessions passed to Engine.HandleConn have to be created with this
+// When the engine uses handshakes, sending on it blocks until Engine.HandleConn finished the handshake
+func NewSession(conn Connection) Session {
+	return Session{
+		Data:  new(SessionStore),
+		Conn:  conn,
+		state: newSessionState(),
+	}
+}
+
+// Returns wether the feature was negotiated in the handshake, unlike Supports this is false for peers without one
+func (s Session) negotiatedFeature(feature Features) bool {
+	negotiated := s.Negotiated()
+	return negotiated != nil && negotiated.Features&feature == feature
+}
+
+// Returns what was negotiated in the handshake, nil if the engine has no Handshake
+// Peers that didn't send a hello get one with a zero Version and no features
+// Only valid after the handshake is done, e.g. in Engine.OnConnOpen
+func (s Session) Negotiated() *Negotiated {
+	if s.state == nil {
+		return nil
+	}
+	return s.state.negotiated
+}
+
+// Reads from the connection, remembering the error if it failed
+func (s Session) read(buf []byte) error {
+	err := s.Conn.Read(buf)
+	if err != nil {
+		s.state.readErr = err
+	}
+	return err
+}
+
+// Returns the smoothed round trip time measured by the heartbeat, 0 if nothing was measured yet
+func (s Session) RTT() time.Duration {
+	if s.state == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&s.state.rtt))
+}
+
+// Returns wether the peer supports feature, if the engine has no Handshake the peer is assumed to support everything
+func (s Session) Supports(feature Features) bool {
+	negotiated := s.Negotiated()
+	return negotiated == nil || negotiated.Features&feature == feature
+}
+
+type SessionStore struct {
+	Data  map[string]interface{}
+	Mutex sync.RWMutex
+}
+
+func (s *SessionStore) Set(key string, val interface{}) {
+	s.Mutex.Lock()
+	if s.Data == nil {
+		s.Data = make(map[string]interface{})
+	}
+	s.Data[key] = val
+	s.Mutex.Unlock()
+}
+
+func (s *SessionStore) Get(key string) (val interface{}, exists bool) {
+	s.Mutex.RLock()
+	if s.Data == nil {
+		s.Data = make(map[string]interface{})
+	}
+
+	value, exists := s.Data[key]
+	s.Mutex.RUnlock()
+	return value, exists
+}
+
+func (s *SessionStore) GetString(key string) (val string, exists bool) {
+	value, exists := s.Get(key)
+	if !exists {
+		return "", false
+	}
+
+	str := value.(string)
+	return str, true
+}
+
+func (s *SessionStore) GetBool(key string) (val bool, exists bool) {
+	raw, exists := s.Get(key)
+	if exists {
+		val, _ = raw.(bool)
+	}
+	return
+}
+
+func (s *SessionStore) GetInt(key string) (val int, exists bool) {
+	raw, exists := s.Get(key)
+	if exists {
+		val, _ = raw.(int)
+	}
+	return
+}
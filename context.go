@@ -0,0 +1,119 @@
+package fnet
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"time"
+)
+
+// Reserved event id's used to cancel requests handled by handlers taking a context.Context
+const (
+	EvtCancel          int32 = -13 // Cancels a request, the payload is its request id
+	EvtDeadlineRequest int32 = -14 // A request with a deadline, the payload is the request id, the time left as int64 nanoseconds and the wire message
+)
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// A request being handled
+type incomingRequest struct {
+	id       uint32
+	deadline time.Time // Zero if the caller didn't send one
+}
+
+// Returns the context passed to the handler and a function releasing it once the handler is done
+// The context is cancelled when the session closes, and for requests when the deadline passes or the peer cancels it
+func (e *Engine) handlerContext(handler Handler, session Session, req *incomingRequest) (context.Context, func()) {
+	if !handler.takesContext {
+		return nil, func() {}
+	}
+
+	state := session.state
+	if req == nil {
+		return state.ctx, func() {}
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.deadline.IsZero() {
+		ctx, cancel = context.WithCancel(state.ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(state.ctx, req.deadline)
+	}
+
+	state.requestsLock.Lock()
+	state.requests[req.id] = cancel
+	state.requestsLock.Unlock()
+	return ctx, func() {
+		state.requestsLock.Lock()
+		delete(state.requests, req.id)
+		state.requestsLock.Unlock()
+		cancel()
+	}
+}
+
+// Handles a request with the time the caller waits for the response
+func (e *Engine) handleDeadlineRequest(payload []byte, session Session) error {
+	if len(payload) < 12 {
+		return ErrMalformedMessage
+	}
+
+	req := &incomingRequest{
+		id:       binary.LittleEndian.Uint32(payload),
+		deadline: time.Now().Add(time.Duration(binary.LittleEndian.Uint64(payload[4:]))),
+	}
+	f, err := e.parseFrame(payload[12:])
+	if err != nil {
+		return err
+	}
+	return e.callRequestHandler(req, f.evtId, f.payload, session)
+}
+
+// Cancels the context of a request, requests that are done already are ignored
+func (e *Engine) handleCancel(payload []byte, session Session) error {
+	if len(payload) < 4 {
+		return ErrMalformedMessage
+	}
+
+	state := session.state
+	state.requestsLock.Lock()
+	cancel := state.requests[binary.LittleEndian.Uint32(payload)]
+	state.requestsLock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+// Tells the peer to cancel the request with reqId, if it supports it
+func (e *Engine) sendCancel(session Session, reqId uint32) error {
+	if !session.negotiatedFeature(FeatureCancel) {
+		return nil
+	}
+
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, reqId)
+	wireMessage, err := e.createWireMessage(EvtCancel, payload)
+	if err != nil {
+		return err
+	}
+	// Sent with the priority of the request, a higher one could overtake it and the peer would ignore the cancel
+	return e.send(session, wireMessage)
+}
+
+// Creates a request message, sent with the context's deadline if the peer supports it
+func (e *Engine) createRequest(ctx context.Context, session Session, reqId uint32, evtId int32, data interface{}) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || !session.negotiatedFeature(FeatureCancel) {
+		return e.createWrapped(session, EvtRequest, reqId, evtId, data)
+	}
+
+	inner, err := e.createMessage(session, evtId, data)
+	if err != nil {
+		return make([]byte, 0), err
+	}
+	payload := make([]byte, 12, 12+len(inner))
+	binary.LittleEndian.PutUint32(payload, reqId)
+	binary.LittleEndian.PutUint64(payload[4:], uint64(time.Until(deadline)))
+	return e.createWireMessage(EvtDeadlineRequest, append(payload, inner...))
+}
@@ -0,0 +1,168 @@
+package fnet
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// How handlers are run
+type DispatchMode int
+
+const (
+	// Handlers run on the goroutine reading the session, one at a time
+	// A slow handler delays everything else the peer sent
+	DispatchInline DispatchMode = iota
+	// Handlers run on a shared pool of Engine.Workers goroutines
+	// Messages from the same session are still handled one at a time in the order they were received
+	DispatchPool
+	// Every message is handled on a new goroutine
+	DispatchConcurrent
+)
+
+// Max number of messages per session waiting for a worker with DispatchPool
+// Reading from the session blocks while it's full
+const maxPendingJobs = 64
+
+// Max number of messages a worker handles from a session before giving other sessions a turn
+const jobsPerTurn = 16
+
+// The messages of a session waiting to be handled by the worker pool
+type jobQueue struct {
+	lock    sync.Mutex
+	jobs    []func()
+	running bool          // Set while the queue is waiting for or owned by a worker
+	slots   chan struct{} // Limits the number of pending jobs
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{slots: make(chan struct{}, maxPendingJobs)}
+}
+
+// A pool of workers handling the queues of sessions with pending messages
+type workerPool struct {
+	queues chan *jobQueue
+}
+
+func (e *Engine) workerPool() *workerPool {
+	e.poolOnce.Do(func() {
+		workers := e.Workers
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+
+		e.pool = &workerPool{queues: make(chan *jobQueue, workers)}
+		for i := 0; i < workers; i++ {
+			go e.pool.work()
+		}
+	})
+	return e.pool
+}
+
+// Adds a job to the queue, handing the queue to a worker if none has it already
+func (p *workerPool) push(q *jobQueue, job func()) {
+	q.slots <- struct{}{}
+
+	q.lock.Lock()
+	q.jobs = append(q.jobs, job)
+	schedule := !q.running
+	q.running = true
+	q.lock.Unlock()
+
+	if schedule {
+		p.queues <- q
+	}
+}
+
+func (p *workerPool) work() {
+	for q := range p.queues {
+		p.run(q)
+	}
+}
+
+// Handles the jobs in q until it's empty, or until another worker can take over after jobsPerTurn jobs
+func (p *workerPool) run(q *jobQueue) {
+	for i := 1; ; i++ {
+		q.lock.Lock()
+		if len(q.jobs) == 0 {
+			q.running = false
+			q.lock.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs[0] = nil
+		q.jobs = q.jobs[1:]
+		q.lock.Unlock()
+
+		job()
+		<-q.slots
+
+		if i >= jobsPerTurn {
+			// Give other sessions a turn by putting the queue back, unless the pool is busy
+			select {
+			case p.queues <- q:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// Runs job according to Engine.Dispatch and the handlers concurrency limit
+// Jobs that don't run inline report their errors instead of returning them
+func (e *Engine) schedule(session Session, handler Handler, job func() error) error {
+	run := handler.limited(job)
+
+	switch e.Dispatch {
+	case DispatchPool:
+		e.workerPool().push(session.state.jobs, func() {
+			e.reportAsync(session, run())
+		})
+	case DispatchConcurrent:
+		go func() {
+			e.reportAsync(session, run())
+		}()
+	default:
+		return run()
+	}
+	return nil
+}
+
+// Wraps job so it waits while Handler.MaxConcurrent messages are being handled
+func (h Handler) limited(job func() error) func() error {
+	if h.limit == nil {
+		return job
+	}
+	return func() error {
+		h.limit <- struct{}{}
+		defer func() { <-h.limit }()
+		return job()
+	}
+}
+
+// Takes one of the Handler.MaxConcurrent slots without waiting, returns false if they're all taken
+func (h Handler) tryAcquire() bool {
+	if h.limit == nil {
+		return true
+	}
+	select {
+	case h.limit <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Frees a slot taken with tryAcquire
+func (h Handler) release() {
+	if h.limit != nil {
+		<-h.limit
+	}
+}
+
+// Handles the error of a message that wasn't handled inline
+func (e *Engine) reportAsync(session Session, err error) {
+	if err != nil && !e.panicked(session, err) {
+		fmt.Println("Error: ", err)
+	}
+}
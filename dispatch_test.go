@@ -0,0 +1,99 @@
+package fnet
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDispatchPoolOrder(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Dispatch = DispatchPool
+	srv.Workers = 4
+	received := make(chan testMsg, 100)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	for i := 0; i < 100; i++ {
+		cli.CreateAndSend(cs, 1, testMsg{Text: strconv.Itoa(i)})
+	}
+
+	// Messages from the same session are handled in order
+	for i := 0; i < 100; i++ {
+		if msg := receive(t, received); msg.Text != strconv.Itoa(i) {
+			t.Fatalf("got %s, expected %d", msg.Text, i)
+		}
+	}
+}
+
+func TestDispatchConcurrent(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchConcurrent, DispatchPool} {
+		srv, cli := newEngines()
+		srv.Dispatch = mode
+		srv.Workers = 3
+		started, release := make(chan bool, 3), make(chan bool)
+		defer close(release)
+		srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+			started <- true
+			<-release
+		}, 1))
+
+		// With the pool every session is handled one at a time, so they need their own
+		_, cs := connect(t, srv, cli)
+		sessions := []Session{cs, reconnect(t, srv, cli), reconnect(t, srv, cli)}
+		for _, cs := range sessions {
+			cli.CreateAndSend(cs, 1, testMsg{})
+		}
+		// Every handler runs at once
+		for range sessions {
+			receive(t, started)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Dispatch = DispatchConcurrent
+	started, release := make(chan bool, 5), make(chan bool)
+	handler := NewHandlerSafe(func(session Session, msg testMsg) {
+		started <- true
+		<-release
+	}, 1)
+	handler.MaxConcurrent = 2
+	srv.AddHandler(handler)
+	_, cs := connect(t, srv, cli)
+
+	for i := 0; i < 5; i++ {
+		cli.CreateAndSend(cs, 1, testMsg{})
+	}
+	receive(t, started)
+	receive(t, started)
+	select {
+	case <-started:
+		t.Fatal("more than MaxConcurrent messages handled at once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The others are handled once there's room
+	for i := 0; i < 3; i++ {
+		release <- true
+		receive(t, started)
+	}
+	release <- true
+	release <- true
+}
+
+// Connects another pipe between engines already started by connect, returns the client session
+func reconnect(t testing.TB, srv, cli *Engine) Session {
+	a, b := newPipe()
+	cs := NewSession(b)
+	go srv.HandleConn(NewSession(a))
+	go cli.HandleConn(cs)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return cs
+}
@@ -1,49 +1,124 @@
-package fnet
-
-import (
-	"encoding/json"
-	"errors"
-	"github.com/golang/protobuf/proto"
-)
-
-type Encoder interface {
-	Marshal(in interface{}) ([]byte, error)
-	Unmarshal(data []byte, obj interface{}) error
-}
-
-// The standard protocol buffer encoder
-type ProtoEncoder struct{}
-
-var ErrNotProtoMessage = errors.New("Proto encoder/decoder reuquires proto.Message to be implemented")
-
-func (p ProtoEncoder) Marshal(in interface{}) ([]byte, error) {
-	cast, ok := in.(proto.Message)
-	if !ok {
-		return []byte{}, ErrNotProtoMessage
-	}
-
-	out, err := proto.Marshal(cast)
-	return out, err
-}
-
-func (p ProtoEncoder) Unmarshal(data []byte, obj interface{}) error {
-	cast, ok := obj.(proto.Message)
-	if !ok {
-		return ErrNotProtoMessage
-	}
-	err := proto.Unmarshal(data, cast)
-	return err
-}
-
-// Json encoder/dedboder
-type JsonEncoder struct{}
-
-func (p JsonEncoder) Marshal(in interface{}) ([]byte, error) {
-	out, err := json.Marshal(in)
-	return out, err
-}
-
-func (p JsonEncoder) Unmarshal(data []byte, obj interface{}) error {
-	err := json.Unmarshal(data, obj)
-	return err
-}
+package fnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	protov2 "google.golang.org/protobuf/proto"
+	"reflect"
+	"sync"
+)
+
+// Encoders must not keep references to the data passed to Unmarshal, the buffer is reused afterwards
+type Encoder interface {
+	Marshal(in interface{}) ([]byte, error)
+	Unmarshal(data []byte, obj interface{}) error
+}
+
+// Implemented by encoders that can encode directly into an existing buffer
+type AppendMarshaler interface {
+	// Appends the encoded message to dst and returns the extended buffer
+	AppendMarshal(dst []byte, in interface{}) ([]byte, error)
+}
+
+// Optionally implemented by encoders to check the message types of handlers when they're added
+type TypeChecker interface {
+	// Returns an error if values of type t can't be passed to Marshal and Unmarshal
+	CheckType(t reflect.Type) error
+}
+
+// Encoders that can be negotiated in the handshake, their names as keys
+var (
+	encoders = map[string]Encoder{
+		"proto": ProtoEncoder{},
+		"json":  JsonEncoder{},
+	}
+	encodersLock sync.RWMutex
+)
+
+// Registers an encoder under name so it can be negotiated in the handshake
+func RegisterEncoder(name string, encoder Encoder) {
+	encodersLock.Lock()
+	encoders[name] = encoder
+	encodersLock.Unlock()
+}
+
+// Returns the encoder registered under name
+func GetEncoder(name string) (encoder Encoder, found bool) {
+	encodersLock.RLock()
+	encoder, found = encoders[name]
+	encodersLock.RUnlock()
+	return
+}
+
+// The standard protocol buffer encoder
+type ProtoEncoder struct{}
+
+var ErrNotProtoMessage = errors.New("Proto encoder/decoder reuquires proto.Message to be implemented")
+
+func (p ProtoEncoder) Marshal(in interface{}) ([]byte, error) {
+	cast, ok := in.(proto.Message)
+	if !ok {
+		return []byte{}, ErrNotProtoMessage
+	}
+
+	out, err := proto.Marshal(cast)
+	return out, err
+}
+
+// Implements AppendMarshaler
+func (p ProtoEncoder) AppendMarshal(dst []byte, in interface{}) ([]byte, error) {
+	cast, ok := in.(proto.Message)
+	if !ok {
+		return dst, ErrNotProtoMessage
+	}
+
+	// proto.Buffer allocates itself, MarshalAppend doesn't
+	return protov2.MarshalOptions{}.MarshalAppend(dst, proto.MessageV2(cast))
+}
+
+func (p ProtoEncoder) Unmarshal(data []byte, obj interface{}) error {
+	cast, ok := obj.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	err := proto.Unmarshal(data, cast)
+	return err
+}
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// Implements TypeChecker
+func (p ProtoEncoder) CheckType(t reflect.Type) error {
+	if !t.Implements(protoMessageType) {
+		return fmt.Errorf("%s does not implement proto.Message", t)
+	}
+	return nil
+}
+
+// Json encoder/dedboder
+type JsonEncoder struct{}
+
+func (p JsonEncoder) Marshal(in interface{}) ([]byte, error) {
+	out, err := json.Marshal(in)
+	return out, err
+}
+
+func (p JsonEncoder) Unmarshal(data []byte, obj interface{}) error {
+	err := json.Unmarshal(data, obj)
+	return err
+}
+
+// Implements TypeChecker
+func (p JsonEncoder) CheckType(t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return fmt.Errorf("%s can't be encoded as json", t)
+	}
+	return nil
+}
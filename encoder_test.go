@@ -0,0 +1,85 @@
+package fnet
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// Reads the same data over and over
+type repeatConn struct {
+	readerConn
+	data []byte
+	pos  int
+}
+
+func (c *repeatConn) Read(buf []byte) error {
+	for n := 0; n < len(buf); {
+		copied := copy(buf[n:], c.data[c.pos:])
+		n += copied
+		c.pos = (c.pos + copied) % len(c.data)
+	}
+	return nil
+}
+
+var benchMessage = &wrappers.StringValue{Value: "Hello, this is a chat message"}
+
+func TestAppendWireMessageAllocs(t *testing.T) {
+	e := DefaultEngine()
+	dst := make([]byte, 0, 128)
+	allocs := testing.AllocsPerRun(100, func() {
+		dst, _ = e.AppendWireMessage(dst[:0], 1, benchMessage)
+	})
+	if allocs != 0 {
+		t.Fatalf("AppendWireMessage allocated %v times per call", allocs)
+	}
+}
+
+func TestReadFrameAllocs(t *testing.T) {
+	e := DefaultEngine()
+	wireMessage, err := e.CreateWireMessage(1, benchMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(&repeatConn{data: wireMessage})
+
+	allocs := testing.AllocsPerRun(100, func() {
+		f, _ := e.readFrame(session)
+		f.release()
+	})
+	if allocs != 0 {
+		t.Fatalf("readFrame allocated %v times per call", allocs)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	e := DefaultEngine()
+	dst := make([]byte, 0, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		dst, err = e.AppendWireMessage(dst[:0], 1, benchMessage)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	e := DefaultEngine()
+	wireMessage, err := e.CreateWireMessage(1, benchMessage)
+	if err != nil {
+		b.Fatal(err)
+	}
+	session := NewSession(&repeatConn{data: wireMessage})
+
+	b.SetBytes(int64(len(wireMessage)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f, err := e.readFrame(session)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.release()
+	}
+}
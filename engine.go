@@ -1,260 +1,884 @@
-package fnet
-
-import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
-	"log"
-	"reflect"
-	"sync/atomic"
-	"time"
-)
-
-// The networking engine. Holds togheter all the connections and handlers
-type Engine struct {
-	Encoder     Encoder // The encoder/decoder to use
-	OnConnOpen  func(Session)
-	OnConnClose func(Session)
-
-	registerSession   chan Session // Channel for registering new connections
-	unregisterSession chan Session // Channel for unregistering connections
-	broadcastChan     chan []byte  // Channel for broadcasting messages to all connections
-
-	listeners  []Listener        // Slice Containing all listeners
-	handlers   map[int32]Handler // Map with all the event handlers, their id's as keys
-	sessions   map[Session]bool  // Map containing all conncetions
-	ErrChan    chan error
-	numClients *int32
-}
-
-func DefaultEngine() *Engine {
-	var nClients int32
-	return &Engine{
-		ErrChan: make(chan error),
-		Encoder: ProtoEncoder{},
-
-		registerSession:   make(chan Session),
-		unregisterSession: make(chan Session),
-		broadcastChan:     make(chan []byte),
-		listeners:         make([]Listener, 0),
-		handlers:          make(map[int32]Handler),
-		sessions:          make(map[Session]bool),
-		numClients:        &nClients,
-	}
-}
-
-func (e *Engine) Broadcast(msg []byte) {
-	e.broadcastChan <- msg
-}
-
-// Adds a listener and make it start listening for incoming connections
-func (e *Engine) AddListener(listener Listener) {
-	e.listeners = append(e.listeners, listener)
-	if !listener.IsListening() {
-		go func() {
-			err := listener.Listen()
-			e.ErrChan <- err
-		}()
-	}
-}
-
-// Handles connections
-func (e *Engine) HandleConn(session Session) {
-	session.Conn.Run()
-
-	e.registerSession <- session
-	if e.OnConnOpen != nil {
-		e.OnConnOpen(session)
-	}
-
-	for {
-		err := e.readMessage(session)
-		if err != nil {
-			fmt.Println("Error: ", err)
-			if err != ErrNoHandlerFound {
-				break
-			}
-		}
-	}
-
-	session.Conn.Close()
-	e.unregisterSession <- session
-	if e.OnConnClose != nil {
-		e.OnConnClose(session)
-	}
-}
-
-func (e *Engine) readMessage(session Session) error {
-	conn := session.Conn
-
-	// start with receving the evt id and payload length
-	header := make([]byte, 8)
-	err := conn.Read(header)
-	if err != nil {
-		return err
-	}
-	evtId, pl, err := readHeader(header)
-	if err != nil {
-		return err
-	}
-	payload := make([]byte, pl)
-	if pl > 0 {
-		err = conn.Read(payload)
-		if err != nil {
-			return err
-		}
-	} else {
-		//fmt.Println("No payload!")
-	}
-	return e.handleMessage(evtId, payload, session)
-}
-
-func readHeader(header []byte) (evtId int32, payloadLength int32, err error) {
-	buf := bytes.NewReader(header)
-
-	err = binary.Read(buf, binary.LittleEndian, &evtId)
-	if err != nil {
-		return
-	}
-
-	err = binary.Read(buf, binary.LittleEndian, &payloadLength)
-	if err != nil {
-		return
-	}
-	return
-}
-
-// Retrieves the event id, decodes the data and calls the callback
-func (e *Engine) handleMessage(evtId int32, payload []byte, seesion Session) error {
-	started := time.Now()
-
-	defer func() {
-		since := time.Since(started)
-		log.Printf("Took %fμs to handle message %d\n", float64(since.Nanoseconds()/1000), evtId)
-	}()
-
-	handler, found := e.handlers[evtId]
-	if !found {
-		return ErrNoHandlerFound
-	}
-
-	var args = make([]reflect.Value, 0)
-	sesisonVal := reflect.ValueOf(seesion)
-	args = append(args, sesisonVal)
-	if len(payload) > 0 {
-		decoded := reflect.New(handler.DataType).Interface() // We use reflect to unmarshal the data into the appropiate typewww
-		err := e.Encoder.Unmarshal(payload, decoded)
-		if err != nil {
-			return err
-		}
-		decVal := reflect.Indirect(reflect.ValueOf(decoded)) // decoded is a pointer, so we get the value it points to
-		args = append(args, decVal)
-	}
-	// ready the function
-	funcVal := reflect.ValueOf(handler.CallBack)
-	resp := funcVal.Call(args) // Call it
-	if len(resp) == 0 {
-		return nil
-	}
-
-	// Todo, allow the handlers to return stuff to send
-	// for a simple request response type structure
-
-	return nil
-}
-
-// Adds a handler
-func (e *Engine) AddHandler(handler Handler) {
-	e.handlers[handler.Event] = handler
-}
-
-// Adds multiple handlers
-func (e *Engine) AddHandlers(handlers ...Handler) {
-	for _, v := range handlers {
-		e.AddHandler(v)
-	}
-}
-
-// Listen for messages on all the channels
-func (e *Engine) ListenChannels() {
-	for {
-		select {
-		case d := <-e.registerSession: //Register a connection
-			e.sessions[d] = true
-			atomic.AddInt32(e.numClients, 1)
-		case d := <-e.unregisterSession: //Unregister a connection
-			delete(e.sessions, d)
-			atomic.AddInt32(e.numClients, -1)
-		case msg := <-e.broadcastChan: //Broadcast a message to all connections
-			for sess := range e.sessions {
-				go func(session Session) {
-					err := session.Conn.Send(msg)
-					if err != nil {
-						e.ErrChan <- err
-						session.Conn.Close()
-					}
-				}(sess)
-			}
-		}
-	}
-}
-
-func (e *Engine) NumClients() int {
-	return int(atomic.LoadInt32(e.numClients))
-}
-
-func (e *Engine) CreateWireMessage(evtId int32, data interface{}) ([]byte, error) {
-	// Encode the message itself
-	encoded := make([]byte, 0)
-	if data != nil {
-		e, err := e.Encoder.Marshal(data)
-		if err != nil {
-			return make([]byte, 0), err
-		}
-		encoded = e
-	}
-
-	// Create a new buffer, stuff the event id and the encoded message in it
-	buffer := new(bytes.Buffer)
-	err := binary.Write(buffer, binary.LittleEndian, evtId)
-	if err != nil {
-		return make([]byte, 0), err
-	}
-
-	// Add the length to the buffer
-	length := len(encoded)
-	err = binary.Write(buffer, binary.LittleEndian, int32(length))
-	if err != nil {
-		return make([]byte, 0), err
-	}
-
-	// Then the actual payload, if any
-	if len(encoded) > 0 {
-		_, err = buffer.Write(encoded)
-		if err != nil {
-			return make([]byte, 0), err
-		}
-
-	}
-
-	unread := buffer.Bytes()
-	return unread, nil
-}
-
-func (e *Engine) CreateAndSend(session Session, evtId int32, data interface{}) error {
-	wireMessage, err := e.CreateWireMessage(evtId, data)
-	if err != nil {
-		return err
-	}
-
-	return session.Conn.Send(wireMessage)
-}
-
-func (e *Engine) CreateAndBroadcast(evtId int32, data interface{}) error {
-	wireMessage, err := e.CreateWireMessage(evtId, data)
-	if err != nil {
-		return err
-	}
-	e.Broadcast(wireMessage)
-	return nil
-}
+package fnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The max payload size used by DefaultEngine
+const DefaultMaxPayloadSize = 4 << 20 // 4MB
+
+// The networking engine. Holds togheter all the connections and handlers
+type Engine struct {
+	Encoder Encoder // The encoder/decoder to use
+	// Max size of a payload in bytes, 0 for no limit
+	// Handlers can override this with Handler.MaxPayloadSize
+	MaxPayloadSize int32
+	OnConnOpen     func(Session)
+	// Called when a session is closed, with the reason it was closed for
+	OnConnClose func(session Session, info CloseInfo)
+	// How long Session.Close waits for queued messages to be written, DefaultCloseTimeout is used if 0
+	CloseTimeout time.Duration
+	// If set a handshake is exchanged with the peer when a connection is opened
+	Handshake *Handshake
+	// If set peers are pinged to measure the round trip time and detect dead connections
+	Heartbeat *Heartbeat
+	// Reads and writes the message headers, DefaultFrameCodec is used if nil
+	FrameCodec FrameCodec
+	// Messages bigger than this are compressed, if compression was negotiated in the handshake
+	CompressThreshold int
+	// Append a crc32 checksum to every message sent, for transports that don't guarantee integrity
+	// Messages with a checksum are always verified, wether this is set or not
+	Checksum bool
+	// Messages with a payload bigger than this are split into fragments, 0 to never split messages
+	FragmentSize int
+	// Max number of bytes buffered for reassembling fragmented messages per session, 0 for no limit
+	MaxReassemblySize int
+	// Log how long every message took to handle
+	LogTimings bool
+	// What happens to a session when a handler panics while handling one of its messages
+	PanicPolicy PanicPolicy
+	// Called with panics recovered in handlers, if nil they're sent on ErrChan if something is receiving and printed otherwise
+	OnPanic func(session Session, err *PanicError)
+	// How handlers are run, DispatchInline by default
+	// With DispatchInline nothing reads the session while a handler runs, so its context is only cancelled when the peer
+	// closes the connection if Heartbeat is set and fails to send a ping, the other modes notice it right away
+	Dispatch DispatchMode
+	// Number of goroutines handling messages with DispatchPool, runtime.NumCPU() if 0
+	Workers int
+	// Called with messages for events without a handler, the payload is only valid until it returns
+	// It's called on the goroutine reading the session no matter what Dispatch is
+	NotFound func(session Session, evtId int32, payload []byte) error
+	// Sessions are closed after sending this many messages for events without a handler, 0 for no limit
+	MaxUnknownEvents int
+
+	registerSession   chan Session   // Channel for registering new connections
+	unregisterSession chan Session   // Channel for unregistering connections
+	broadcastChan     chan broadcast // Channel for broadcasting messages to all connections
+
+	listeners    []Listener        // Slice Containing all listeners
+	handlers     map[int32]Handler // Map with all the event handlers, their id's as keys
+	handlersLock sync.RWMutex      // Guards handlers and maxHandlerPayload, they can change while sessions are handled
+	sessions     map[Session]bool  // Map containing all conncetions
+	ErrChan      chan error
+	numClients   *int32
+
+	// Called with errors the peer sent back when handling one of our messages failed, they're printed if nil
+	// Errors for requests made with Call or Go are returned by those instead
+	OnPeerError func(session Session, err *Error)
+
+	// Called with responses to requests sent with SendRequest, the payload is only valid until it returns
+	OnResponse    func(session Session, reqId uint32, evtId int32, payload []byte)
+	lastRequestId *uint32
+	pendingCalls  map[uint32]*Call // Calls waiting for a response, request id's as keys
+	pendingLock   sync.Mutex
+
+	interceptors     []Interceptor     // Added with Use
+	sendInterceptors []SendInterceptor // Added with UseOutbound
+
+	pool     *workerPool // Started when it's first used
+	poolOnce sync.Once
+
+	maxHandlerPayload int32 // The biggest Handler.MaxPayloadSize
+	checksumErrors    *uint64
+	lastStreamId      *uint32
+}
+
+func DefaultEngine() *Engine {
+	var nClients int32
+	var lastReqId uint32
+	var checksumErrors uint64
+	var lastStreamId uint32
+	return &Engine{
+		ErrChan:        make(chan error),
+		Encoder:        ProtoEncoder{},
+		MaxPayloadSize: DefaultMaxPayloadSize,
+
+		CompressThreshold: DefaultCompressThreshold,
+		MaxReassemblySize: DefaultMaxReassemblySize,
+
+		registerSession:   make(chan Session),
+		unregisterSession: make(chan Session),
+		broadcastChan:     make(chan broadcast),
+		listeners:         make([]Listener, 0),
+		handlers:          make(map[int32]Handler),
+		sessions:          make(map[Session]bool),
+		numClients:        &nClients,
+		lastRequestId:     &lastReqId,
+		checksumErrors:    &checksumErrors,
+		lastStreamId:      &lastStreamId,
+		pendingCalls:      make(map[uint32]*Call),
+	}
+}
+
+// A message to be sent to all sessions
+type broadcast struct {
+	wireMessage []byte // Encoded with Engine.Encoder
+
+	// Set if the message was created by CreateAndBroadcast
+	// used to encode it again for sessions using a different encoder
+	created bool
+	evtId   int32
+	data    interface{}
+}
+
+func (e *Engine) Broadcast(msg []byte) {
+	e.broadcastChan <- broadcast{wireMessage: msg}
+}
+
+// Adds a listener and make it start listening for incoming connections
+func (e *Engine) AddListener(listener Listener) {
+	e.listeners = append(e.listeners, listener)
+	if !listener.IsListening() {
+		go func() {
+			err := listener.Listen()
+			e.ErrChan <- err
+		}()
+	}
+}
+
+// Handles connections, the session has to be created with NewSession
+func (e *Engine) HandleConn(session Session) {
+	if session.state == nil {
+		// The state would only exist in this copy, so responses, Session.Close and the handshake wouldn't work for the caller's
+		panic("fnet: HandleConn called with a Session not created by NewSession")
+	}
+	session.state.setEngine(e)
+	session.Conn.Run()
+
+	var first *frame
+	if e.Handshake == nil {
+		close(session.state.ready)
+	} else {
+		var err error
+		first, err = e.handshake(session)
+		if err != nil {
+			fmt.Println("Handshake failed: ", err)
+			session.Conn.Close()
+			return
+		}
+	}
+
+	e.registerSession <- session
+	if e.OnConnOpen != nil {
+		e.OnConnOpen(session)
+	}
+
+	if e.Heartbeat != nil && session.Supports(FeatureHeartbeat) {
+		go e.heartbeat(session)
+	}
+
+	// The peer didn't send a hello, so its first message has to be handled normally
+	if first != nil {
+		err := e.handleFrame(session, *first)
+		if err != nil {
+			fmt.Println("Error: ", err)
+		}
+	}
+
+	for {
+		err := e.readMessage(session)
+		if err != nil {
+			if err == errClosedByPeer || session.state.getClose() != nil {
+				// Closed with a close message, or locally in which case the read error is expected
+				break
+			}
+			if e.panicked(session, err) {
+				break
+			}
+			if isMessageError(err) {
+				fmt.Println("Error: ", err)
+				continue
+			}
+			if isProtocolError(err) {
+				// Tell the peer why it's being disconnected
+				e.closeSession(session, CloseInfo{
+					Cause:  CauseProtocolError,
+					Code:   CloseProtocolError,
+					Reason: err.Error(),
+					Err:    err,
+				})
+				break
+			}
+
+			info := e.abnormalClose(session, err)
+			if e.OnConnClose == nil {
+				fmt.Println("Connection closed:", info.Cause, info.Err)
+			}
+			session.state.setClose(info)
+			break
+		}
+	}
+
+	session.Conn.Close()
+	close(session.state.done)
+	session.state.cancel()
+	e.failCalls(session, ErrConnClosed)
+	e.closeStreams(session)
+	e.unregisterSession <- session
+	if e.OnConnClose != nil {
+		e.OnConnClose(session, *session.state.getClose())
+	}
+}
+
+// Returns wether err was caused by the peer sending something invalid
+func isProtocolError(err error) bool {
+	return err == ErrPayloadTooLarge || err == ErrInvalidLength || err == ErrMalformedMessage
+}
+
+// Returns wether err only affected a single message, so the connection can be kept open
+func isMessageError(err error) bool {
+	switch err.(type) {
+	case *HandlerError, *Error, *PanicError:
+		return true
+	}
+	return err == ErrNoHandlerFound || err == ErrChecksumMismatch || err == ErrHandlerBusy
+}
+
+func (e *Engine) readMessage(session Session) error {
+	f, err := e.readFrame(session)
+	if err != nil {
+		return err
+	}
+	return e.handleFrame(session, f)
+}
+
+// Handles and releases a frame read from the session
+func (e *Engine) handleFrame(session Session, f frame) error {
+	// Pongs aren't read while a handler runs inline, so the heartbeat doesn't count them as missed
+	atomic.StoreInt32(&session.state.handling, 1)
+	err := e.handleMessage(f.evtId, f.payload, session)
+	atomic.StoreInt32(&session.state.handling, 0)
+	f.release()
+	return err
+}
+
+// A single message as read from a connection
+type frame struct {
+	evtId   int32
+	payload []byte
+	buf     *[]byte // Pooled buffer holding the payload, released when the message is handled
+}
+
+// Returns the payload buffer to the pool, the payload can't be used after this
+func (f *frame) release() {
+	putBuffer(f.buf)
+	f.buf = nil
+	f.payload = nil
+}
+
+// Reads the next message from the session's connection without handling it
+func (e *Engine) readFrame(session Session) (frame, error) {
+	// start with receving the evt id and payload length
+	var header Header
+	var err error
+	if fixed, ok := e.frameCodec().(FixedSizeFrameCodec); ok && fixed.HeaderSize() <= len(session.state.header) {
+		// Avoids allocating a buffer for every header
+		buf := session.state.header[:fixed.HeaderSize()]
+		err = session.read(buf)
+		if err != nil {
+			return frame{}, err
+		}
+		header, err = checkHeader(fixed.DecodeHeader(buf))
+	} else {
+		header, err = e.readHeader(connReader{session})
+	}
+	if err != nil {
+		return frame{}, err
+	}
+	if max := e.maxPayloadSize(header.Event); max > 0 && header.Length > max {
+		return frame{}, ErrPayloadTooLarge
+	}
+	session.state.received = time.Now()
+	session.state.extra = header.Extra
+
+	f := frame{evtId: header.Event}
+	if header.Length > 0 {
+		f.buf = getBuffer(int(header.Length))
+		f.payload = *f.buf
+		err = session.read(f.payload)
+		if err != nil {
+			f.release()
+			return frame{}, err
+		}
+	} else {
+		//fmt.Println("No payload!")
+	}
+
+	if header.Event == EvtChecksum {
+		inner, err := e.verifyChecksum(f.payload)
+		if err != nil {
+			f.release()
+			return frame{}, err
+		}
+		inner.buf = f.buf
+		return inner, nil
+	}
+	return f, nil
+}
+
+// Reads a header using the engine's frame codec
+func (e *Engine) readHeader(r io.Reader) (Header, error) {
+	return checkHeader(e.frameCodec().ReadHeader(r))
+}
+
+// Validates a header read by a codec
+func checkHeader(header Header, err error) (Header, error) {
+	if err != nil {
+		return header, err
+	}
+
+	if header.Length < 0 {
+		return header, ErrInvalidLength
+	}
+	return header, nil
+}
+
+// Returns the frame codec used by the engine
+func (e *Engine) frameCodec() FrameCodec {
+	if e.FrameCodec == nil {
+		return DefaultFrameCodec
+	}
+	return e.FrameCodec
+}
+
+// Returns the max payload size allowed for evtId, 0 if there's no limit
+func (e *Engine) maxPayloadSize(evtId int32) int32 {
+	e.handlersLock.RLock()
+	handler, found := e.handlers[evtId]
+	maxHandlerPayload := e.maxHandlerPayload
+	e.handlersLock.RUnlock()
+
+	if found && handler.MaxPayloadSize > 0 {
+		return handler.MaxPayloadSize
+	}
+
+	// Reserved events wrap other messages, so they're allowed to be as big as the biggest of those
+	if IsReservedEvent(evtId) && e.MaxPayloadSize > 0 {
+		if maxHandlerPayload > e.MaxPayloadSize {
+			return maxHandlerPayload + envelopeOverhead
+		}
+		return e.MaxPayloadSize + envelopeOverhead
+	}
+	return e.MaxPayloadSize
+}
+
+// Retrieves the event id, decodes the data and calls the callback
+func (e *Engine) handleMessage(evtId int32, payload []byte, seesion Session) error {
+	if e.LogTimings {
+		started := time.Now()
+
+		defer func() {
+			since := time.Since(started)
+			log.Printf("Took %fμs to handle message %d\n", float64(since.Nanoseconds()/1000), evtId)
+		}()
+	}
+
+	if IsReservedEvent(evtId) {
+		if handler, ok := systemHandlers[evtId]; ok {
+			return handler(e, payload, seesion)
+		}
+		return ErrNoHandlerFound
+	}
+
+	return e.callHandler(evtId, payload, seesion, nil, func(resp interface{}, err error) error {
+		if err != nil {
+			e.sendError(seesion, evtId, err)
+		}
+		return err
+	})
+}
+
+// Decodes the payload and calls the handler for evtId, done is called with whatever the handler returned
+// The handler and done run according to Engine.Dispatch, the payload isn't used after this returns
+// req is set if the message is a request
+func (e *Engine) callHandler(evtId int32, payload []byte, session Session, req *incomingRequest, done func(resp interface{}, err error) error) error {
+	handler, found := e.handler(evtId)
+	if !found {
+		return done(nil, e.notFound(evtId, payload, session))
+	}
+
+	if max := e.maxPayloadSize(evtId); max > 0 && int32(len(payload)) > max {
+		return done(nil, ErrPayloadTooLarge)
+	}
+
+	if handler.DataType == readerType && e.Dispatch != DispatchInline {
+		// The reader would be used after the payload buffer is reused
+		payload = append([]byte(nil), payload...)
+	}
+	msg, err := e.decodeMessage(handler, session, payload)
+	if err != nil {
+		return done(nil, err)
+	}
+
+	var envelope *Message
+	if handler.envelope {
+		envelope = session.state.envelope(evtId, len(payload))
+	}
+	ctx, release := e.handlerContext(handler, session, req)
+	return e.schedule(session, handler, func() error {
+		defer release()
+		return done(e.dispatch(ctx, handler, session, envelope, msg))
+	})
+}
+
+// Handles a message for an event without a handler
+func (e *Engine) notFound(evtId int32, payload []byte, session Session) error {
+	session.state.unknownEvents++
+	if e.MaxUnknownEvents > 0 && session.state.unknownEvents > e.MaxUnknownEvents {
+		e.closeSession(session, CloseInfo{
+			Cause:  CauseProtocolError,
+			Code:   ClosePolicyViolation,
+			Reason: "Too many unknown events",
+			Err:    ErrNoHandlerFound,
+		})
+		return ErrNoHandlerFound
+	}
+
+	if e.NotFound == nil {
+		return ErrNoHandlerFound
+	}
+	return e.callNotFound(evtId, payload, session)
+}
+
+// Calls Engine.NotFound, panics are recovered and returned as a *PanicError so Engine.PanicPolicy applies
+func (e *Engine) callNotFound(evtId int32, payload []byte, session Session) (err error) {
+	defer e.recoverHandler(session, evtId, &err)
+
+	err = e.NotFound(session, evtId, payload)
+	if err != nil {
+		return &HandlerError{Event: evtId, Err: err}
+	}
+	return nil
+}
+
+// Decodes the payload into the handler's message type, nil if the handler doesn't take a message
+// Handlers taking a pointer get the decoded value without copying it
+func (e *Engine) decodeMessage(handler Handler, session Session, payload []byte) (interface{}, error) {
+	if handler.typed != nil {
+		return handler.typed.decode(e, session, payload)
+	}
+
+	if handler.DataType == readerType {
+		// Stream handlers read the raw payload
+		return bytes.NewReader(payload), nil
+	} else if handler.DataType != nil {
+		elem := handler.DataType
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		decoded := reflect.New(elem).Interface() // We use reflect to unmarshal the data into the appropiate typewww
+		if len(payload) > 0 {
+			err := e.encoder(session).Unmarshal(payload, decoded)
+			if err != nil {
+				return nil, decodeError(err)
+			}
+		}
+		if handler.DataType.Kind() == reflect.Ptr {
+			return decoded, nil
+		}
+		return reflect.Indirect(reflect.ValueOf(decoded)).Interface(), nil // decoded is a pointer, so we get the value it points to
+	}
+	return nil, nil
+}
+
+// Calls the handler with msg through the interceptors added with Use, ctx and envelope are only set for handlers taking them
+// Panics in the handler or interceptors are recovered and returned as a *PanicError
+func (e *Engine) dispatch(ctx context.Context, handler Handler, session Session, envelope *Message, msg interface{}) (resp interface{}, err error) {
+	defer e.recoverHandler(session, handler.Event, &err)
+
+	next := func(session Session, evtId int32, msg interface{}) (interface{}, error) {
+		return e.invoke(ctx, handler, session, envelope, msg)
+	}
+
+	// The first interceptor added is the outermost one
+	for i := len(e.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := e.interceptors[i], next
+		next = func(session Session, evtId int32, msg interface{}) (interface{}, error) {
+			return interceptor(session, evtId, msg, inner)
+		}
+	}
+	resp, err = next(session, handler.Event, msg)
+	if err != nil && !isMessageError(err) {
+		// Errors returned by interceptors only affect this message
+		err = &HandlerError{Event: handler.Event, Err: err}
+	}
+	return resp, err
+}
+
+// Calls the handler with ctx, the session, envelope and msg, returning whatever the handler returned
+func (e *Engine) invoke(ctx context.Context, handler Handler, session Session, envelope *Message, msg interface{}) (interface{}, error) {
+	if handler.typed != nil {
+		return handler.typed.call(ctx, session, envelope, msg)
+	}
+
+	var args = make([]reflect.Value, 0)
+	if handler.takesContext {
+		args = append(args, reflect.ValueOf(&ctx).Elem())
+	}
+	sesisonVal := reflect.ValueOf(session)
+	args = append(args, sesisonVal)
+	if handler.envelope {
+		args = append(args, reflect.ValueOf(envelope))
+	}
+	if handler.DataType != nil {
+		data := reflect.ValueOf(msg)
+		if !data.IsValid() {
+			data = reflect.Zero(handler.DataType)
+		}
+		args = append(args, data)
+	}
+	// ready the function
+	funcVal := reflect.ValueOf(handler.CallBack)
+	resp := funcVal.Call(args) // Call it
+	if len(resp) == 0 {
+		return nil, nil
+	}
+
+	// Handlers returning (response, error) are request handlers, others may return just an error
+	if errVal := resp[len(resp)-1]; !errVal.IsNil() {
+		return nil, &HandlerError{Event: handler.Event, Err: errVal.Interface().(error)}
+	}
+	if len(resp) == 1 {
+		return nil, nil
+	}
+	respVal := resp[0]
+	switch respVal.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if respVal.IsNil() {
+			return nil, nil
+		}
+	}
+	return respVal.Interface(), nil
+}
+
+// Returns the handler for evtId
+func (e *Engine) handler(evtId int32) (Handler, bool) {
+	e.handlersLock.RLock()
+	handler, found := e.handlers[evtId]
+	e.handlersLock.RUnlock()
+	return handler, found
+}
+
+// Adds a handler, safe to call while sessions are being handled
+// Returns ErrHandlerExists if the event already has one, ErrReservedEvent if the event is in the reserved range
+// and an error if the callback is invalid or uses types the engine's encoder can't handle
+func (e *Engine) AddHandler(handler Handler) error {
+	handler, err := e.prepareHandler(handler)
+	if err != nil {
+		return err
+	}
+
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+	if _, found := e.handlers[handler.Event]; found {
+		return ErrHandlerExists
+	}
+	e.setHandler(handler)
+	return nil
+}
+
+// Replaces the handler for handler.Event, messages already being handled finish with the old one
+// Returns ErrNoHandlerFound if the event doesn't have a handler, and the same errors as AddHandler otherwise
+func (e *Engine) ReplaceHandler(handler Handler) error {
+	handler, err := e.prepareHandler(handler)
+	if err != nil {
+		return err
+	}
+
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+	if _, found := e.handlers[handler.Event]; !found {
+		return ErrNoHandlerFound
+	}
+	e.setHandler(handler)
+	return nil
+}
+
+// Removes the handler for evtId, messages already being handled finish with it
+// Returns ErrNoHandlerFound if the event doesn't have a handler
+func (e *Engine) RemoveHandler(evtId int32) error {
+	e.handlersLock.Lock()
+	defer e.handlersLock.Unlock()
+	if _, found := e.handlers[evtId]; !found {
+		return ErrNoHandlerFound
+	}
+	delete(e.handlers, evtId)
+	e.updateMaxHandlerPayload()
+	return nil
+}
+
+// Stores the handler, handlersLock has to be held
+func (e *Engine) setHandler(handler Handler) {
+	e.handlers[handler.Event] = handler
+	e.updateMaxHandlerPayload()
+}
+
+// Recalculates maxHandlerPayload, handlersLock has to be held
+func (e *Engine) updateMaxHandlerPayload() {
+	e.maxHandlerPayload = 0
+	for _, handler := range e.handlers {
+		if handler.MaxPayloadSize > e.maxHandlerPayload {
+			e.maxHandlerPayload = handler.MaxPayloadSize
+		}
+	}
+}
+
+// Validates a handler before it's added
+func (e *Engine) prepareHandler(handler Handler) (Handler, error) {
+	if IsReservedEvent(handler.Event) {
+		return handler, ErrReservedEvent
+	}
+
+	// Handlers created with Handle are checked by the compiler
+	if handler.typed == nil {
+		err := validateCallback(handler.CallBack)
+		if err != nil {
+			return handler, err
+		}
+
+		t := reflect.TypeOf(handler.CallBack)
+		params, _ := parseParams(t)
+		if handler.DataType != params.data {
+			return handler, fmt.Errorf("DataType of the handler for event %d doesn't match its callback %s", handler.Event, t)
+		}
+		handler.takesContext = params.context
+		handler.envelope = params.envelope
+	}
+	err := e.checkEncoder(handler)
+	if err != nil {
+		return handler, err
+	}
+	if handler.MaxConcurrent > 0 {
+		handler.limit = make(chan struct{}, handler.MaxConcurrent)
+	}
+	return handler, nil
+}
+
+// Adds multiple handlers, stopping at the first one that fails
+func (e *Engine) AddHandlers(handlers ...Handler) error {
+	for _, v := range handlers {
+		err := e.AddHandler(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Listen for messages on all the channels
+func (e *Engine) ListenChannels() {
+	for {
+		select {
+		case d := <-e.registerSession: //Register a connection
+			e.sessions[d] = true
+			atomic.AddInt32(e.numClients, 1)
+		case d := <-e.unregisterSession: //Unregister a connection
+			delete(e.sessions, d)
+			atomic.AddInt32(e.numClients, -1)
+		case msg := <-e.broadcastChan: //Broadcast a message to all connections
+			prepared := make(map[sessionFormat][][]byte) // The message for each combination of negotiated settings
+			for sess := range e.sessions {
+				format := sess.state.format()
+				wireMessages, ok := prepared[format]
+				if !ok {
+					var err error
+					wireMessages, err = e.prepareBroadcast(sess, msg)
+					if err != nil {
+						go func() { e.ErrChan <- err }()
+						continue
+					}
+					prepared[format] = wireMessages
+				}
+
+				go func(session Session, msgs [][]byte) {
+					for _, msg := range msgs {
+						err := session.Conn.Send(msg)
+						if err != nil {
+							e.ErrChan <- err
+							session.Conn.Close()
+							return
+						}
+					}
+				}(sess, wireMessages)
+			}
+		}
+	}
+}
+
+// Creates the broadcast message for session
+func (e *Engine) prepareBroadcast(session Session, msg broadcast) ([][]byte, error) {
+	wireMessage := msg.wireMessage
+	if msg.created && session.state.encoder != nil {
+		var err error
+		wireMessage, err = e.createMessage(session, msg.evtId, msg.data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.prepare(session, wireMessage)
+}
+
+func (e *Engine) NumClients() int {
+	return int(atomic.LoadInt32(e.numClients))
+}
+
+func (e *Engine) CreateWireMessage(evtId int32, data interface{}) ([]byte, error) {
+	return e.encodeWireMessage(e.Encoder, evtId, data)
+}
+
+// Appends the wire message to dst and returns the extended buffer
+// Nothing is allocated if dst is big enough, the encoder implements AppendMarshaler and the codec FixedSizeFrameCodec
+func (e *Engine) AppendWireMessage(dst []byte, evtId int32, data interface{}) ([]byte, error) {
+	fixed, isFixed := e.frameCodec().(FixedSizeFrameCodec)
+	appender, isAppender := e.Encoder.(AppendMarshaler)
+	if !isFixed || !isAppender || data == nil {
+		wireMessage, err := e.CreateWireMessage(evtId, data)
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, wireMessage...), nil
+	}
+
+	// Reserve room for the header and fill it in when the length is known
+	start := len(dst)
+	headerSize := fixed.HeaderSize()
+	dst = append(dst, make([]byte, headerSize)...)
+	dst, err := appender.AppendMarshal(dst, data)
+	if err != nil {
+		return dst[:start], err
+	}
+
+	length := len(dst) - start - headerSize
+	if length > math.MaxInt32 {
+		return dst[:start], ErrPayloadTooLarge
+	}
+	fixed.AppendHeader(dst[start:start], Header{Event: evtId, Length: int32(length)})
+	return dst, nil
+}
+
+// Same as CreateWireMessage but uses the encoder negotiated with session
+func (e *Engine) createMessage(session Session, evtId int32, data interface{}) ([]byte, error) {
+	e.waitHandshake(session)
+	return e.encodeWireMessage(e.encoder(session), evtId, data)
+}
+
+// Returns the encoder used for session
+func (e *Engine) encoder(session Session) Encoder {
+	if session.state != nil && session.state.encoder != nil {
+		return session.state.encoder
+	}
+	return e.Encoder
+}
+
+func (e *Engine) encodeWireMessage(encoder Encoder, evtId int32, data interface{}) ([]byte, error) {
+	// Encode the message itself
+	encoded := make([]byte, 0)
+	if data != nil {
+		m, err := encoder.Marshal(data)
+		if err != nil {
+			return make([]byte, 0), err
+		}
+		encoded = m
+	}
+
+	return e.createWireMessage(evtId, encoded)
+}
+
+// Creates a wire message from an already encoded payload
+func (e *Engine) createWireMessage(evtId int32, encoded []byte) ([]byte, error) {
+	if len(encoded) > math.MaxInt32 {
+		return make([]byte, 0), ErrPayloadTooLarge
+	}
+
+	// Stuff the header and the encoded message in a buffer
+	header := Header{Event: evtId, Length: int32(len(encoded))}
+	buffer := make([]byte, 0, maxHeaderSize+len(encoded))
+	buffer = e.frameCodec().AppendHeader(buffer, header)
+
+	// Then the actual payload, if any
+	buffer = append(buffer, encoded...)
+	return buffer, nil
+}
+
+func (e *Engine) CreateAndSend(session Session, evtId int32, data interface{}) error {
+	return e.CreateAndSendPriority(session, evtId, data, PriorityNormal)
+}
+
+// Same as CreateAndSend but sent with priority, if the connection supports priorities
+func (e *Engine) CreateAndSendPriority(session Session, evtId int32, data interface{}, priority Priority) error {
+	return e.intercept(session, evtId, data, func(session Session, evtId int32, data interface{}) error {
+		wireMessage, err := e.createMessage(session, evtId, data)
+		if err != nil {
+			return err
+		}
+
+		return e.sendPriority(session, wireMessage, priority)
+	})
+}
+
+// Sends a wire message to session, compressing it if that was negotiated
+func (e *Engine) send(session Session, wireMessage []byte) error {
+	return e.sendPriority(session, wireMessage, PriorityNormal)
+}
+
+func (e *Engine) sendPriority(session Session, wireMessage []byte, priority Priority) error {
+	wireMessages, err := e.prepare(session, wireMessage)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range wireMessages {
+		err = SendPriority(session.Conn, msg, priority)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the settings negotiated with session to a wire message
+// Returns multiple messages if it had to be split into fragments
+func (e *Engine) prepare(session Session, wireMessage []byte) ([][]byte, error) {
+	wireMessage, err := e.compress(session, wireMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	wireMessages, err := e.fragment(session, wireMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, msg := range wireMessages {
+		wireMessages[i], err = e.addChecksum(session, msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wireMessages, nil
+}
+
+func (e *Engine) CreateAndBroadcast(evtId int32, data interface{}) error {
+	return e.intercept(Session{}, evtId, data, func(_ Session, evtId int32, data interface{}) error {
+		wireMessage, err := e.CreateWireMessage(evtId, data)
+		if err != nil {
+			return err
+		}
+		e.broadcastChan <- broadcast{
+			wireMessage: wireMessage,
+			created:     true,
+			evtId:       evtId,
+			data:        data,
+		}
+		return nil
+	})
+}
@@ -0,0 +1,389 @@
+package fnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// One end of an in memory connection, sent messages are written by a separate goroutine like the tcp and ws connections do
+type pipeConn struct {
+	conn      net.Conn
+	sendChan  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a, b := net.Pipe()
+	return newPipeConn(a), newPipeConn(b)
+}
+
+func newPipeConn(conn net.Conn) *pipeConn {
+	return &pipeConn{
+		conn:     conn,
+		sendChan: make(chan []byte, 1024),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (p *pipeConn) Send(b []byte) error {
+	select {
+	case p.sendChan <- b:
+		return nil
+	case <-p.closed:
+		return ErrConnClosed
+	}
+}
+
+func (p *pipeConn) Read(buf []byte) error {
+	_, err := io.ReadFull(p.conn, buf)
+	return err
+}
+
+func (p *pipeConn) Kind() string { return "pipe" }
+func (p *pipeConn) IP() string   { return "" }
+
+func (p *pipeConn) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.conn.Close()
+	})
+}
+
+func (p *pipeConn) Open() bool {
+	select {
+	case <-p.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *pipeConn) Run() {
+	go func() {
+		for {
+			select {
+			case b := <-p.sendChan:
+				if _, err := p.conn.Write(b); err != nil {
+					p.Close()
+					return
+				}
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Returns a server and client engine encoding messages as json, so plain structs can be used as messages
+func newEngines() (*Engine, *Engine) {
+	srv, cli := DefaultEngine(), DefaultEngine()
+	srv.Encoder = JsonEncoder{}
+	cli.Encoder = JsonEncoder{}
+	return srv, cli
+}
+
+type testMsg struct {
+	Text string
+}
+
+// Starts handling both ends of a pipe, returns the server and client sessions
+func connect(t testing.TB, srv, cli *Engine) (Session, Session) {
+	t.Helper()
+	for _, e := range []*Engine{srv, cli} {
+		go e.ListenChannels()
+		go func(e *Engine) {
+			for range e.ErrChan {
+			}
+		}(e)
+	}
+
+	a, b := newPipe()
+	ss, cs := NewSession(a), NewSession(b)
+	go srv.HandleConn(ss)
+	go cli.HandleConn(cs)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return ss, cs
+}
+
+// Fails the test if nothing is received on c within a second
+func receive[T any](t testing.TB, c chan T) T {
+	t.Helper()
+	select {
+	case v := <-c:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+func TestHandleConnNeedsNewSession(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("HandleConn didn't panic for a session without state")
+		}
+	}()
+
+	a, _ := newPipe()
+	DefaultEngine().HandleConn(Session{Conn: a, Data: new(SessionStore)})
+}
+
+func TestHeartbeatDefaultInterval(t *testing.T) {
+	e := DefaultEngine()
+	e.Heartbeat = &Heartbeat{MaxMissed: 3}
+	session := NewSession(newReaderConn(nil))
+	close(session.state.done)
+
+	// Returns right away since the session is closed, NewTicker used to panic on the zero interval first
+	e.heartbeat(session)
+}
+
+func TestCloseWhileStarting(t *testing.T) {
+	srv := DefaultEngine()
+	closed := make(chan CloseInfo, 1)
+	srv.OnConnClose = func(session Session, info CloseInfo) {
+		closed <- info
+	}
+	go srv.ListenChannels()
+
+	a, b := newPipe()
+	defer b.Close()
+	session := NewSession(a)
+	go srv.HandleConn(session)
+
+	// Races with HandleConn, like kicking a session from another goroutine
+	session.Close(ClosePolicyViolation, "kicked")
+	if info := receive(t, closed); info.Cause != CauseLocalClose || info.Code != ClosePolicyViolation {
+		t.Fatal(info)
+	}
+
+	// The peer never sends its hello, closing doesn't wait for the handshake
+	srv.Handshake = &Handshake{}
+	a, b = newPipe()
+	defer b.Close()
+	session = NewSession(a)
+	go srv.HandleConn(session)
+	for session.state.getEngine() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Close(CloseGoingAway, "shutting down")
+	}()
+	if err := receive(t, done); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, a.closed)
+}
+
+func TestChangeHandlersWhileHandling(t *testing.T) {
+	srv, cli := DefaultEngine(), DefaultEngine()
+	srv.Dispatch = DispatchPool
+	_, cs := connect(t, srv, cli)
+
+	handled := make(chan int32, 1)
+	newHandler := func(evtId int32, maxPayload int32) Handler {
+		handler, err := NewHandler(func(session Session) {
+			select {
+			case handled <- evtId:
+			default:
+			}
+		}, evtId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.MaxPayloadSize = maxPayload
+		return handler
+	}
+
+	const events = 4
+	var wg sync.WaitGroup
+	for evtId := int32(1); evtId <= events; evtId++ {
+		wg.Add(1)
+		go func(evtId int32) {
+			defer wg.Done()
+			for i := int32(0); i < 500; i++ {
+				srv.AddHandler(newHandler(evtId, 100+i))
+				srv.ReplaceHandler(newHandler(evtId, 200+i))
+				srv.RemoveHandler(evtId)
+			}
+		}(evtId)
+	}
+	changed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(changed)
+	}()
+
+	// Keeps sending messages for the events until the handlers are done changing
+sending:
+	for i := 0; ; i++ {
+		select {
+		case <-changed:
+			break sending
+		default:
+		}
+		if err := cli.CreateAndSend(cs, int32(i%events)+1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages are still handled once the handlers settle
+	for len(handled) > 0 {
+		<-handled
+	}
+	if err := srv.AddHandler(newHandler(events+1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.CreateAndSend(cs, events+1, nil); err != nil {
+		t.Fatal(err)
+	}
+	for receive(t, handled) != events+1 {
+	}
+}
+
+func TestHandleRequestContext(t *testing.T) {
+	srv, cli := DefaultEngine(), DefaultEngine()
+	srv.Dispatch = DispatchPool
+	err := srv.AddHandler(HandleRequestContext(1, func(ctx context.Context, session Session, info *Message, req *wrappers.StringValue) (*wrappers.StringValue, error) {
+		if ctx == nil || ctx.Err() != nil || info == nil || info.Event != 1 {
+			return nil, errors.New("Missing context or message")
+		}
+		return &wrappers.StringValue{Value: req.Value + "!"}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cs := connect(t, srv, cli)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp := new(wrappers.StringValue)
+	if err := cli.Call(ctx, cs, 1, &wrappers.StringValue{Value: "hi"}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Value != "hi!" {
+		t.Fatal(resp.Value)
+	}
+}
+
+func TestInlineHandlerCancelledOnClose(t *testing.T) {
+	srv, cli := DefaultEngine(), DefaultEngine()
+	srv.Heartbeat = &Heartbeat{Interval: 10 * time.Millisecond}
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	srv.AddHandler(NewHandlerSafe(func(ctx context.Context, session Session) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	if err := cli.CreateAndSend(cs, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, started)
+	cs.Conn.Close()
+	if err := receive(t, cancelled); err != context.Canceled {
+		t.Fatal("context not cancelled when the peer closed the connection")
+	}
+}
+
+func TestHeartbeatLongInlineHandler(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Heartbeat = &Heartbeat{Interval: 20 * time.Millisecond, MaxMissed: 3}
+	closed := make(chan CloseInfo, 1)
+	srv.OnConnClose = func(session Session, info CloseInfo) {
+		closed <- info
+	}
+	done := make(chan bool, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		// The pongs for the pings sent meanwhile aren't read until this returns
+		time.Sleep(300 * time.Millisecond)
+		done <- true
+	}, 1))
+	ss, cs := connect(t, srv, cli)
+
+	if err := cli.CreateAndSend(cs, 1, testMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, done)
+
+	select {
+	case info := <-closed:
+		t.Fatalf("healthy connection closed: %v", info.Cause)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !ss.Conn.Open() {
+		t.Fatal("healthy connection closed")
+	}
+}
+
+// Records the event id and priority of every message sent on it
+type priorityConn struct {
+	*pipeConn
+	sent chan [2]int32
+}
+
+func (p priorityConn) Send(b []byte) error {
+	return p.SendPriority(b, PriorityNormal)
+}
+
+func (p priorityConn) SendPriority(b []byte, priority Priority) error {
+	evtId := int32(binary.LittleEndian.Uint32(b))
+	if evtId != EvtHello && evtId != EvtAccept {
+		p.sent <- [2]int32{evtId, int32(priority)}
+	}
+	return p.pipeConn.Send(b)
+}
+
+func TestCancelPriority(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Handshake, cli.Handshake = &Handshake{}, &Handshake{}
+	// Inline handlers would keep the cancel from being read
+	srv.Dispatch = DispatchConcurrent
+	cancelled := make(chan bool, 1)
+	srv.AddHandler(NewHandlerSafe(func(ctx context.Context, session Session, msg testMsg) (*testMsg, error) {
+		<-ctx.Done()
+		cancelled <- true
+		return nil, ctx.Err()
+	}, 1))
+	a, b := newPipe()
+	serve(t, srv, a)
+	conn := priorityConn{pipeConn: b, sent: make(chan [2]int32, 8)}
+	cs := serve(t, cli, conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call := cli.Go(ctx, cs, 1, testMsg{}, new(testMsg), nil)
+	request := receive(t, conn.sent)
+	cancel()
+	if call := <-call.Done; call.Error != context.Canceled {
+		t.Fatal(call.Error)
+	}
+	receive(t, cancelled)
+
+	// The cancel can't overtake the request
+	if request != [2]int32{EvtRequest, int32(PriorityNormal)} {
+		t.Fatalf("got request %v", request)
+	}
+	if sent := receive(t, conn.sent); sent != [2]int32{EvtCancel, request[1]} {
+		t.Fatalf("got cancel %v, expected the request's priority %d", sent, request[1])
+	}
+}
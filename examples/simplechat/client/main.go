@@ -26,7 +26,7 @@ func panicErr(err error) {
 func listenErrors(engine *fnet.Engine) {
 	for {
 		err := <-engine.ErrChan
-		fmt.Printf("fnet Error: ", err.Error())
+		fmt.Println("fnet Error: ", err.Error())
 	}
 }
 
@@ -92,6 +92,6 @@ func main() {
 	}
 }
 
-func HandleMsg(session fnet.Session, msg simplechat.ChatMsg) {
+func HandleMsg(session fnet.Session, msg *simplechat.ChatMsg) {
 	fmt.Printf("[%s]: %s\n", msg.GetFrom(), msg.GetMsg())
 }
@@ -33,7 +33,7 @@ func listenErrors() {
 	for {
 		select {
 		case err := <-engine.ErrChan:
-			fmt.Printf("fnet Error: ", err.Error())
+			fmt.Println("fnet Error: ", err.Error())
 		case _ = <-signalChan:
 			fmt.Println("Recived signal, ending...")
 			return
@@ -93,7 +93,7 @@ func HandleConnectionOpen(session fnet.Session) {
 	fmt.Println("A connection opened!")
 }
 
-func HandleConnectionClose(session fnet.Session) {
+func HandleConnectionClose(session fnet.Session, info fnet.CloseInfo) {
 	name, _ := session.Data.GetString("name")
 	msg := &simplechat.ChatMsg{
 		From: proto.String("server"),
@@ -104,10 +104,10 @@ func HandleConnectionClose(session fnet.Session) {
 		fmt.Println("Error: ", err)
 		return
 	}
-	fmt.Println(name + " Left the chat! D:")
+	fmt.Println(name+" Left the chat! D: cause:", info.Cause, "code:", info.Code, "reason:", info.Reason, "error:", info.Err)
 }
 
-func HandleUserJoin(session fnet.Session, user simplechat.User) {
+func HandleUserJoin(session fnet.Session, user *simplechat.User) {
 	name := user.GetName()
 	session.Data.Set("name", name)
 	msg := &simplechat.ChatMsg{
@@ -124,11 +124,11 @@ func HandleUserJoin(session fnet.Session, user simplechat.User) {
 	}
 }
 
-func HandleUserLeave(session fnet.Session, user simplechat.User) {
+func HandleUserLeave(session fnet.Session, user *simplechat.User) {
 	fmt.Println("UserLeave!")
 }
 
-func HandleSendMsg(session fnet.Session, msg simplechat.ChatMsg) {
+func HandleSendMsg(session fnet.Session, msg *simplechat.ChatMsg) {
 	name, _ := session.Data.GetString("name")
 	response := &simplechat.ChatMsg{
 		From: proto.String(name),
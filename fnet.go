@@ -1,82 +1,247 @@
-package fnet
-
-import (
-	"errors"
-	"reflect"
-)
-
-var (
-	ErrCantStopListener   = errors.New("Unable to stop listener")
-	ErrSliceLengthsDiffer = errors.New("Slice lengths differ")
-	ErrConnClosed         = errors.New("Connection closed")
-	ErrTimeout            = errors.New("Timed out")
-	ErrNoHandlerFound     = errors.New("No Handler found")
-)
-
-// Listener is a interface for listening for incoming connections
-type Listener interface {
-	Listen() error     // Listens for incoming connections
-	IsListening() bool // Returns wether this listener is listening or not
-	Stop() error       // Stops listening for incoming connections and
-}
-
-// Struct which represents an event
-type Event struct {
-	Id   int32
-	Data reflect.Value
-}
-
-// Struct which represents a event handler
-type Handler struct {
-	CallBack interface{}
-	Event    int32
-	DataType reflect.Type
-}
-
-func NewHandler(callback interface{}, evt int32) (Handler, error) {
-	err := validateCallback(callback)
-	if err != nil {
-		return Handler{}, err
-	}
-
-	t := reflect.TypeOf(callback)
-	var dType reflect.Type
-	if t.NumIn() == 2 {
-		dType = reflect.TypeOf(callback).In(1) // Get the type of the first parameter for later use
-	}
-
-	return Handler{
-		CallBack: callback,
-		Event:    evt,
-		DataType: dType,
-	}, nil
-}
-
-// Panics if an error occurs instead of returning it
-func NewHandlerSafe(callback interface{}, evt int32) Handler {
-	err := validateCallback(callback)
-	if err != nil {
-		panic(err)
-	}
-
-	t := reflect.TypeOf(callback)
-
-	var dType reflect.Type
-	if t.NumIn() == 2 {
-		dType = reflect.TypeOf(callback).In(1) // Get the type of the first parameter for later use
-	}
-
-	return Handler{
-		CallBack: callback,
-		Event:    evt,
-		DataType: dType,
-	}
-}
-
-func validateCallback(callback interface{}) error {
-	t := reflect.TypeOf(callback)
-	if t.Kind() != reflect.Func {
-		return errors.New("Callback not a function")
-	}
-	return nil
-}
+package fnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+var (
+	ErrCantStopListener   = errors.New("Unable to stop listener")
+	ErrSliceLengthsDiffer = errors.New("Slice lengths differ")
+	ErrConnClosed         = errors.New("Connection closed")
+	ErrTimeout            = errors.New("Timed out")
+	ErrNoHandlerFound     = errors.New("No Handler found")
+	ErrMalformedMessage   = errors.New("Malformed message")
+	ErrInvalidLength      = errors.New("Invalid payload length")
+	ErrPayloadTooLarge    = errors.New("Payload too large")
+	ErrUnexpectedHello    = errors.New("Received hello after the handshake")
+	ErrNotSupported       = errors.New("Not supported by the peer")
+	ErrChecksumMismatch   = errors.New("Checksum mismatch, message corrupted")
+	ErrStreamAborted      = errors.New("Stream aborted by the sender")
+	ErrReservedEvent      = errors.New("Event id is in the reserved range")
+	ErrSendTimeout        = errors.New("Timed out waiting for room in the send queue")
+	ErrHandlerExists      = errors.New("A handler for the event already exists")
+	ErrHandlerBusy        = errors.New("Handler is already handling MaxConcurrent streams")
+)
+
+// Returned when a handler returned an error, the connection is kept open
+type HandlerError struct {
+	Event int32
+	Err   error
+}
+
+func (h *HandlerError) Error() string {
+	return fmt.Sprintf("Handler for event %d failed: %s", h.Event, h.Err)
+}
+
+// Listener is a interface for listening for incoming connections
+type Listener interface {
+	Listen() error     // Listens for incoming connections
+	IsListening() bool // Returns wether this listener is listening or not
+	Stop() error       // Stops listening for incoming connections and
+}
+
+// Struct which represents an event
+type Event struct {
+	Id   int32
+	Data reflect.Value
+}
+
+// Handlers taking a io.Reader instead of a message receive the raw payload
+// fragmented messages are streamed to them as the fragments arrive
+var readerType = reflect.TypeOf((*io.Reader)(nil)).Elem()
+
+// Passed to handlers taking a *Message before their message, describes the received message
+type Message struct {
+	Event    int32     // The event id
+	Size     int       // Size of the encoded payload in bytes, -1 for payloads streamed to an io.Reader
+	Received time.Time // When the message, or its last fragment, was read
+	Extra    []byte    // Header.Extra of the frame the message was read from, only set by custom FrameCodecs
+}
+
+var messageType = reflect.TypeOf((*Message)(nil))
+
+// Struct which represents a event handler
+type Handler struct {
+	CallBack interface{}
+	Event    int32
+	DataType reflect.Type
+
+	MaxPayloadSize int32 // Overrides Engine.MaxPayloadSize for this event if above 0
+	MaxConcurrent  int   // Max number of messages for this event handled at once, 0 for no limit
+
+	limit        chan struct{} // Semaphore for MaxConcurrent, created by AddHandler
+	envelope     bool          // Wether the callback takes a *Message, set by AddHandler
+	takesContext bool          // Wether the callback takes a context.Context, set by AddHandler
+
+	typed *typedHandler
+}
+
+func NewHandler(callback interface{}, evt int32) (Handler, error) {
+	err := validateCallback(callback)
+	if err != nil {
+		return Handler{}, err
+	}
+
+	return Handler{
+		CallBack: callback,
+		Event:    evt,
+		DataType: dataType(reflect.TypeOf(callback)),
+	}, nil
+}
+
+// Panics if an error occurs instead of returning it
+func NewHandlerSafe(callback interface{}, evt int32) Handler {
+	err := validateCallback(callback)
+	if err != nil {
+		panic(err)
+	}
+
+	return Handler{
+		CallBack: callback,
+		Event:    evt,
+		DataType: dataType(reflect.TypeOf(callback)),
+	}
+}
+
+// Returns the type of the message parameter of a valid callback, nil if it doesn't take one
+func dataType(callback reflect.Type) reflect.Type {
+	params, _ := parseParams(callback)
+	return params.data
+}
+
+// The parameters a callback takes besides the session
+type callbackParams struct {
+	context  bool         // Wether a context.Context is taken before the session
+	envelope bool         // Wether a *Message is taken after the session
+	data     reflect.Type // The message parameter, nil if there is none
+}
+
+// Checks the parameters of callback position by position: an optional context.Context, the session,
+// an optional *Message and an optional message which can't be any of the others
+func parseParams(t reflect.Type) (callbackParams, error) {
+	var params callbackParams
+	in := make([]reflect.Type, t.NumIn())
+	for i := range in {
+		in[i] = t.In(i)
+	}
+
+	if len(in) > 0 && in[0] == contextType {
+		params.context = true
+		in = in[1:]
+	}
+	switch len(in) {
+	case 1, 2, 3:
+	default:
+		return params, fmt.Errorf("Callback %s has to take either (fnet.Session) or (fnet.Session, message)", t)
+	}
+	if in[0] != sessionType {
+		return params, fmt.Errorf("Callback %s has to take fnet.Session first, or after a context.Context, not %s", t, in[0])
+	}
+	in = in[1:]
+
+	if len(in) > 0 && in[0] == messageType {
+		params.envelope = true
+		in = in[1:]
+	} else if len(in) == 2 {
+		return params, fmt.Errorf("Parameter after the session of callback %s has to be *fnet.Message, not %s", t, in[0])
+	}
+	if len(in) == 0 {
+		return params, nil
+	}
+
+	switch in[0] {
+	case sessionType, messageType, contextType:
+		return params, fmt.Errorf("Message parameter of callback %s can't be %s", t, in[0])
+	}
+	params.data = in[0]
+	return params, nil
+}
+
+var (
+	sessionType = reflect.TypeOf(Session{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Checks that callback is a function taking (Session) or (Session, message) and returning nothing or (response, error)
+// A context.Context can be taken before the session and a *Message after it
+func validateCallback(callback interface{}) error {
+	if callback == nil {
+		return errors.New("Callback is nil")
+	}
+
+	t := reflect.TypeOf(callback)
+	if t.Kind() != reflect.Func {
+		return fmt.Errorf("Callback not a function but %s", t)
+	}
+	if t.IsVariadic() {
+		return fmt.Errorf("Callback %s can't be variadic", t)
+	}
+
+	params, err := parseParams(t)
+	if err != nil {
+		return err
+	}
+	if in := params.data; in != nil {
+		switch in.Kind() {
+		case reflect.Interface:
+			if in != readerType {
+				return fmt.Errorf("Message parameter of callback %s can't be the interface %s, only io.Reader is allowed", t, in)
+			}
+		case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			return fmt.Errorf("Message parameter of callback %s can't be decoded into", t)
+		case reflect.Ptr:
+			if in.Elem().Kind() == reflect.Ptr {
+				return fmt.Errorf("Message parameter of callback %s can't be a pointer to a pointer", t)
+			}
+		}
+	}
+
+	// Handlers can return an error, request handlers return (response, error)
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		if t.Out(0) != errorType {
+			return fmt.Errorf("Return value of callback %s not an error", t)
+		}
+	case 2:
+		if t.Out(1) != errorType {
+			return fmt.Errorf("Second return value of callback %s not an error", t)
+		}
+	default:
+		return fmt.Errorf("Callback %s has to return either nothing, an error or (response, error)", t)
+	}
+	return nil
+}
+
+// Checks that the engine's encoder can decode the handler's messages and encode its responses
+func (e *Engine) checkEncoder(handler Handler) error {
+	checker, ok := e.Encoder.(TypeChecker)
+	if !ok {
+		return nil
+	}
+
+	if handler.DataType != nil && handler.DataType != readerType {
+		// Messages are decoded into a pointer to DataType, or DataType if it's a pointer
+		decoded := handler.DataType
+		if decoded.Kind() != reflect.Ptr {
+			decoded = reflect.PtrTo(decoded)
+		}
+		err := checker.CheckType(decoded)
+		if err != nil {
+			return fmt.Errorf("Handler for event %d can't decode its messages: %s", handler.Event, err)
+		}
+	}
+
+	t := reflect.TypeOf(handler.CallBack)
+	if t.NumOut() == 2 && t.Out(0).Kind() != reflect.Interface {
+		err := checker.CheckType(t.Out(0))
+		if err != nil {
+			return fmt.Errorf("Handler for event %d can't encode its responses: %s", handler.Event, err)
+		}
+	}
+	return nil
+}
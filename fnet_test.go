@@ -0,0 +1,75 @@
+package fnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestValidateCallback(t *testing.T) {
+	valid := []interface{}{
+		func(Session) {},
+		func(Session, string) {},
+		func(Session, string) error { return nil },
+		func(Session, *Message) {},
+		func(Session, *Message, string) {},
+		func(Session, io.Reader) {},
+		func(context.Context, Session) {},
+		func(context.Context, Session, *Message, string) (string, error) { return "", nil },
+	}
+	for _, callback := range valid {
+		if err := validateCallback(callback); err != nil {
+			t.Errorf("%T: %v", callback, err)
+		}
+	}
+
+	invalid := []interface{}{
+		nil,
+		"not a function",
+		func() {},
+		func(string) {},
+		func(Session, Session) {},
+		func(Session, *Message, *Message) {},
+		func(Session, *Message, Session) {},
+		func(Session, context.Context) {},
+		func(Session, string, *Message) {},
+		func(context.Context, context.Context, Session) {},
+		func(Session, *Message, string, string) {},
+		func(Session, ...string) {},
+		func(Session) string { return "" },
+		func(Session) (error, string) { return nil, "" },
+	}
+	for _, callback := range invalid {
+		if err := validateCallback(callback); err == nil {
+			t.Errorf("%T wasn't rejected", callback)
+		}
+	}
+}
+
+func TestErrorCallback(t *testing.T) {
+	srv, cli := newEngines()
+	received := make(chan testMsg, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) error {
+		if msg.Text == "fail" {
+			return errors.New("Failed")
+		}
+		received <- msg
+		return nil
+	}, 1))
+	peerErrors := make(chan *Error, 1)
+	cli.OnPeerError = func(session Session, err *Error) {
+		peerErrors <- err
+	}
+	_, cs := connect(t, srv, cli)
+
+	cli.CreateAndSend(cs, 1, testMsg{Text: "fail"})
+	if err := receive(t, peerErrors); err.Code != StatusUnknown || err.Message != "Failed" {
+		t.Fatalf("got %v", err)
+	}
+	// The error only affected that message
+	cli.CreateAndSend(cs, 1, testMsg{Text: "a"})
+	if msg := receive(t, received); msg.Text != "a" {
+		t.Fatalf("got %q, expected %q", msg.Text, "a")
+	}
+}
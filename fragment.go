@@ -0,0 +1,277 @@
+package fnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Reserved event id for a fragment of a message
+// The payload is a 32 bit stream id, a byte of flags and the data
+// The data of the first fragment starts with the event id of the message, the rest of the data is the payload
+const EvtFragment int32 = -8
+
+// Fragment flags
+const (
+	fragmentFirst byte = 1 << iota // First fragment of the message, the data starts with the event id
+	fragmentLast                   // Last fragment of the message
+	fragmentAbort                  // The sender failed to send the rest, the message should be discarded
+)
+
+// Size of the fragments sent by Engine.SendStream if Engine.FragmentSize isn't set
+const DefaultFragmentSize = 64 * 1024
+
+// The reassembly limit used by DefaultEngine
+const DefaultMaxReassemblySize = 16 << 20 // 16MB
+
+// A fragmented message being received
+type fragmentStream struct {
+	evtId    int32
+	handler  Handler
+	buf      []byte         // The payload so far, unused if streamed to a handler
+	pipe     *io.PipeWriter // Set if the payload is streamed to a handler
+	busy     bool           // Set if the handler was at its MaxConcurrent, the payload is discarded
+	received int64
+}
+
+func (e *Engine) nextStreamId() uint32 {
+	return atomic.AddUint32(e.lastStreamId, 1)
+}
+
+// Splits a wire message into fragments if it's bigger than Engine.FragmentSize and the peer supports it
+func (e *Engine) fragment(session Session, wireMessage []byte) ([][]byte, error) {
+	if e.FragmentSize <= 0 || len(wireMessage) <= e.FragmentSize || !session.Supports(FeatureFragments) {
+		return [][]byte{wireMessage}, nil
+	}
+
+	f, err := e.parseFrame(wireMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	streamId := e.nextStreamId()
+	fragments := make([][]byte, 0, len(f.payload)/e.FragmentSize+1)
+	flags := fragmentFirst
+	for data := f.payload; ; data = data[e.FragmentSize:] {
+		chunk := data
+		if len(data) <= e.FragmentSize {
+			flags |= fragmentLast
+		} else {
+			chunk = data[:e.FragmentSize]
+		}
+
+		fragment, err := e.createFragment(streamId, flags, f.evtId, chunk)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, fragment)
+
+		if flags&fragmentLast != 0 {
+			return fragments, nil
+		}
+		flags = 0
+	}
+}
+
+func (e *Engine) createFragment(streamId uint32, flags byte, evtId int32, data []byte) ([]byte, error) {
+	payload := make([]byte, 5, 9+len(data))
+	binary.LittleEndian.PutUint32(payload, streamId)
+	payload[4] = flags
+	if flags&fragmentFirst != 0 {
+		payload = payload[:9]
+		binary.LittleEndian.PutUint32(payload[5:], uint32(evtId))
+	}
+	payload = append(payload, data...)
+	return e.createWireMessage(EvtFragment, payload)
+}
+
+// Sends everything read from r as the payload of a single message, split into fragments
+// The handler for evtId on the other end should take a io.Reader to read it as it arrives
+func (e *Engine) SendStream(session Session, evtId int32, r io.Reader) error {
+	e.waitHandshake(session)
+	if !session.Supports(FeatureFragments) {
+		return ErrNotSupported
+	}
+
+	size := e.FragmentSize
+	if size <= 0 {
+		size = DefaultFragmentSize
+	}
+
+	streamId := e.nextStreamId()
+	buf := make([]byte, size)
+	flags := fragmentFirst
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			flags |= fragmentLast
+		} else if err != nil {
+			// Let the other end know it's not getting the rest
+			abort, _ := e.createFragment(streamId, flags|fragmentAbort, evtId, nil)
+			e.sendFragment(session, abort)
+			return err
+		}
+
+		fragment, err := e.createFragment(streamId, flags, evtId, buf[:n])
+		if err != nil {
+			return err
+		}
+		err = e.sendFragment(session, fragment)
+		if err != nil {
+			return err
+		}
+
+		if flags&fragmentLast != 0 {
+			return nil
+		}
+		flags = 0
+	}
+}
+
+func (e *Engine) sendFragment(session Session, fragment []byte) error {
+	fragment, err := e.addChecksum(session, fragment)
+	if err != nil {
+		return err
+	}
+	return session.Conn.Send(fragment)
+}
+
+// Adds the fragment to its message, handling the message when it's complete
+func (e *Engine) handleFragment(payload []byte, session Session) error {
+	if len(payload) < 5 {
+		return ErrMalformedMessage
+	}
+
+	state := session.state
+	if state.streams == nil {
+		state.streams = make(map[uint32]*fragmentStream)
+	}
+
+	streamId := binary.LittleEndian.Uint32(payload)
+	flags := payload[4]
+	data := payload[5:]
+
+	stream, found := state.streams[streamId]
+	if flags&fragmentFirst != 0 {
+		if found || len(data) < 4 {
+			return ErrMalformedMessage
+		}
+		stream = &fragmentStream{evtId: int32(binary.LittleEndian.Uint32(data))}
+		data = data[4:]
+		if stream.evtId == EvtFragment {
+			return ErrMalformedMessage
+		}
+
+		if handler, ok := e.handler(stream.evtId); ok && handler.typed == nil && handler.DataType == readerType {
+			stream.handler = handler
+			// Waiting for a slot would stop reading the session, and with it the streams holding the slots
+			if handler.tryAcquire() {
+				stream.pipe = e.startStream(handler, session)
+			} else {
+				stream.busy = true
+			}
+		}
+		state.streams[streamId] = stream
+		if stream.busy {
+			e.sendError(session, stream.evtId, ErrHandlerBusy)
+			if flags&fragmentLast != 0 {
+				e.removeStream(session, streamId, nil)
+			}
+			return ErrHandlerBusy
+		}
+	} else if !found {
+		return ErrMalformedMessage
+	}
+
+	if flags&fragmentAbort != 0 {
+		e.removeStream(session, streamId, ErrStreamAborted)
+		return nil
+	}
+
+	if stream.busy {
+		if flags&fragmentLast != 0 {
+			e.removeStream(session, streamId, nil)
+		}
+		return nil
+	}
+
+	stream.received += int64(len(data))
+	if max := e.maxStreamSize(stream); max > 0 && stream.received > int64(max) {
+		e.removeStream(session, streamId, ErrPayloadTooLarge)
+		return ErrPayloadTooLarge
+	}
+
+	if stream.pipe != nil {
+		// Blocks until the handler read it, errors mean the handler stopped reading and the rest is discarded
+		stream.pipe.Write(data)
+	} else {
+		state.reassembling += len(data)
+		if e.MaxReassemblySize > 0 && state.reassembling > e.MaxReassemblySize {
+			e.removeStream(session, streamId, ErrPayloadTooLarge)
+			return ErrPayloadTooLarge
+		}
+		stream.buf = append(stream.buf, data...)
+	}
+
+	if flags&fragmentLast == 0 {
+		return nil
+	}
+
+	e.removeStream(session, streamId, nil)
+	if stream.pipe != nil {
+		return nil
+	}
+	return e.handleMessage(stream.evtId, stream.buf, session)
+}
+
+// Max number of bytes that can be received in a stream
+func (e *Engine) maxStreamSize(stream *fragmentStream) int32 {
+	if stream.pipe != nil {
+		// Streamed payloads are never held in memory, so only the handlers limit applies
+		return stream.handler.MaxPayloadSize
+	}
+	return e.maxPayloadSize(stream.evtId)
+}
+
+// Runs the stream handler in a new goroutine, the payload is written to the returned pipe
+// The handler's slot has to be acquired already and is released when it returns
+func (e *Engine) startStream(handler Handler, session Session) *io.PipeWriter {
+	var envelope *Message
+	if handler.envelope {
+		envelope = session.state.envelope(handler.Event, -1)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := e.dispatch(session.state.ctx, handler, session, envelope, pr)
+		handler.release()
+		// Unblocks the reading goroutine if the handler didn't read everything
+		pr.Close()
+		if err != nil && !e.panicked(session, err) {
+			fmt.Println("Error: ", err)
+		}
+	}()
+	return pw
+}
+
+// Removes a stream from the session, the reader of a streamed payload gets err or io.EOF if it's nil
+func (e *Engine) removeStream(session Session, streamId uint32, err error) {
+	stream, found := session.state.streams[streamId]
+	if !found {
+		return
+	}
+
+	delete(session.state.streams, streamId)
+	session.state.reassembling -= len(stream.buf)
+	if stream.pipe != nil {
+		stream.pipe.CloseWithError(err)
+	}
+}
+
+// Removes all the streams of a closed session
+func (e *Engine) closeStreams(session Session) {
+	for streamId := range session.state.streams {
+		e.removeStream(session, streamId, ErrConnClosed)
+	}
+}
@@ -0,0 +1,155 @@
+package fnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFragments(t *testing.T) {
+	srv, cli := newEngines()
+	cli.FragmentSize = 64
+	received := make(chan testMsg, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	msg := testMsg{Text: strings.Repeat("fragmented ", 100)}
+	wireMessage, err := cli.CreateWireMessage(1, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragments, err := cli.fragment(cs, wireMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := len(wireMessage)/64 + 1; len(fragments) != expected {
+		t.Fatalf("%d fragments, expected %d", len(fragments), expected)
+	}
+
+	if err := cli.CreateAndSend(cs, 1, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, received); got != msg {
+		t.Fatal("reassembled message differs")
+	}
+}
+
+func TestFragmentReassemblyLimit(t *testing.T) {
+	srv, cli := newEngines()
+	srv.MaxReassemblySize = 256
+	cli.FragmentSize = 64
+	received := make(chan testMsg, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	ss, cs := connect(t, srv, cli)
+
+	if err := cli.CreateAndSend(cs, 1, testMsg{Text: strings.Repeat("fragmented ", 100)}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, ss.Conn.(*pipeConn).closed)
+	if len(received) != 0 {
+		t.Fatal("message bigger than MaxReassemblySize was handled")
+	}
+}
+
+type streamed struct {
+	data []byte
+	err  error
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("Read failed")
+}
+
+func TestSendStream(t *testing.T) {
+	srv, cli := newEngines()
+	streams := make(chan streamed, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, r io.Reader) {
+		data, err := io.ReadAll(r)
+		streams <- streamed{data, err}
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	data := make([]byte, 3*DefaultFragmentSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := cli.SendStream(cs, 1, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if s := receive(t, streams); s.err != nil || !bytes.Equal(s.data, data) {
+		t.Fatalf("got %d bytes and error %v", len(s.data), s.err)
+	}
+
+	// The handler is told when the sender fails to send the rest
+	if err := cli.SendStream(cs, 1, io.MultiReader(bytes.NewReader(data), failingReader{})); err == nil {
+		t.Fatal("SendStream didn't return the read error")
+	}
+	if s := receive(t, streams); s.err != ErrStreamAborted {
+		t.Fatalf("got error %v, expected ErrStreamAborted", s.err)
+	}
+}
+
+func TestStreamsMaxConcurrent(t *testing.T) {
+	srv, cli := newEngines()
+	cli.FragmentSize = 16
+	started := make(chan bool, 2)
+	streams := make(chan streamed, 2)
+	handler, _ := NewHandler(func(session Session, r io.Reader) {
+		data := make([]byte, 16)
+		io.ReadFull(r, data)
+		started <- true
+		rest, err := io.ReadAll(r)
+		streams <- streamed{append(data, rest...), err}
+	}, 1)
+	handler.MaxConcurrent = 1
+	srv.AddHandler(handler)
+	peerErrors := make(chan *Error, 1)
+	cli.OnPeerError = func(session Session, err *Error) {
+		peerErrors <- err
+	}
+	_, cs := connect(t, srv, cli)
+
+	sendStream := func(r io.Reader) chan error {
+		sent := make(chan error, 1)
+		go func() {
+			sent <- cli.SendStream(cs, 1, r)
+		}()
+		return sent
+	}
+	ra, wa := io.Pipe()
+	sentA := sendStream(ra)
+	wa.Write(bytes.Repeat([]byte("a"), 16))
+	receive(t, started)
+
+	// Arrives between the fragments of the first stream while its handler holds the only slot
+	sentB := sendStream(bytes.NewReader(bytes.Repeat([]byte("b"), 64)))
+	if err := receive(t, sentB); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, peerErrors); err.Code != StatusResourceExhausted || err.Event != 1 {
+		t.Fatalf("got %v", err)
+	}
+
+	wa.Write(bytes.Repeat([]byte("a"), 48))
+	wa.Close()
+	if err := receive(t, sentA); err != nil {
+		t.Fatal(err)
+	}
+	if s := receive(t, streams); s.err != nil || !bytes.Equal(s.data, bytes.Repeat([]byte("a"), 64)) {
+		t.Fatalf("got %q and error %v", s.data, s.err)
+	}
+
+	// The slot is free again
+	sendStream(bytes.NewReader(bytes.Repeat([]byte("c"), 32)))
+	if s := receive(t, streams); s.err != nil || !bytes.Equal(s.data, bytes.Repeat([]byte("c"), 32)) {
+		t.Fatalf("got %q and error %v", s.data, s.err)
+	}
+}
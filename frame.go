@@ -0,0 +1,182 @@
+package fnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// The header in front of every message
+type Header struct {
+	Event  int32 // The event id
+	Length int32 // Length of the payload in bytes
+
+	// Any additional fields read by a custom FrameCodec, ignored by the engine
+	Extra []byte
+}
+
+// Reads and writes message headers
+type FrameCodec interface {
+	// Reads a header from r
+	ReadHeader(r io.Reader) (Header, error)
+	// Appends the encoded header to dst and returns the extended slice
+	AppendHeader(dst []byte, header Header) []byte
+}
+
+// Implemented by codecs with a fixed header size
+// Lets the engine read headers into a reused buffer and encode messages without copying the payload
+type FixedSizeFrameCodec interface {
+	FrameCodec
+	HeaderSize() int
+	// Decodes a header from a buffer of HeaderSize bytes
+	DecodeHeader(buf []byte) (Header, error)
+}
+
+// The codec used when Engine.FrameCodec is nil, the original 8 byte little endian header
+var DefaultFrameCodec FrameCodec = FixedCodec{Order: binary.LittleEndian}
+
+// Biggest header written by the included codecs
+const maxHeaderSize = 2 * binary.MaxVarintLen32
+
+// Room for the extra fields and headers of messages wrapped in reserved events, a few levels deep
+const envelopeOverhead = 64
+
+// Writes the event id and payload length as 2 fixed size 32 bit integers
+type FixedCodec struct {
+	Order binary.ByteOrder
+}
+
+// Implements FrameCodec.ReadHeader
+func (f FixedCodec) ReadHeader(r io.Reader) (Header, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return Header{}, err
+	}
+	return f.DecodeHeader(buf)
+}
+
+// Implements FixedSizeFrameCodec.HeaderSize
+func (f FixedCodec) HeaderSize() int {
+	return 8
+}
+
+// Implements FixedSizeFrameCodec.DecodeHeader
+func (f FixedCodec) DecodeHeader(buf []byte) (Header, error) {
+	return Header{
+		Event:  int32(f.Order.Uint32(buf)),
+		Length: int32(f.Order.Uint32(buf[4:])),
+	}, nil
+}
+
+// Implements FrameCodec.AppendHeader
+func (f FixedCodec) AppendHeader(dst []byte, header Header) []byte {
+	if order, ok := f.Order.(binary.AppendByteOrder); ok {
+		dst = order.AppendUint32(dst, uint32(header.Event))
+		return order.AppendUint32(dst, uint32(header.Length))
+	}
+
+	var buf [8]byte
+	f.Order.PutUint32(buf[:], uint32(header.Event))
+	f.Order.PutUint32(buf[4:], uint32(header.Length))
+	return append(dst, buf[:]...)
+}
+
+// Writes the event id as a zig-zag encoded varint and the length as a unsigned varint
+// A message with a small event id and less than 128 bytes of payload has a 2 byte header
+type VarintCodec struct{}
+
+// Implements FrameCodec.ReadHeader
+func (v VarintCodec) ReadHeader(r io.Reader) (Header, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+
+	evtId, err := binary.ReadVarint(br)
+	if err != nil {
+		return Header{}, err
+	}
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return Header{}, noEOF(err)
+	}
+
+	if int64(int32(evtId)) != evtId {
+		return Header{}, ErrMalformedMessage
+	}
+	if length > 1<<31-1 {
+		return Header{}, ErrInvalidLength
+	}
+	return Header{Event: int32(evtId), Length: int32(length)}, nil
+}
+
+// Implements FrameCodec.AppendHeader
+func (v VarintCodec) AppendHeader(dst []byte, header Header) []byte {
+	var buf [maxHeaderSize]byte
+	n := binary.PutVarint(buf[:], int64(header.Event))
+	// Negative lengths are written as lengths too big to be read instead of being sign extended
+	n += binary.PutUvarint(buf[n:], uint64(uint32(header.Length)))
+	return append(dst, buf[:n]...)
+}
+
+// Parses a complete wire message
+func (e *Engine) parseFrame(wireMessage []byte) (frame, error) {
+	var header Header
+	var err error
+	rest := wireMessage
+	if fixed, ok := e.frameCodec().(FixedSizeFrameCodec); ok {
+		if len(wireMessage) < fixed.HeaderSize() {
+			return frame{}, ErrMalformedMessage
+		}
+		header, err = checkHeader(fixed.DecodeHeader(wireMessage))
+		rest = wireMessage[fixed.HeaderSize():]
+	} else {
+		r := bytes.NewReader(wireMessage)
+		header, err = e.readHeader(r)
+		rest = wireMessage[len(wireMessage)-r.Len():]
+	}
+	if err != nil || int(header.Length) != len(rest) {
+		return frame{}, ErrMalformedMessage
+	}
+
+	return frame{evtId: header.Event, payload: rest}, nil
+}
+
+// A EOF in the middle of a header is unexpected
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Makes a session's connection usable as a io.Reader, each read fills the whole buffer
+type connReader struct {
+	session Session
+}
+
+func (c connReader) Read(p []byte) (int, error) {
+	err := c.session.read(p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c connReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	err := c.session.read(buf[:])
+	return buf[0], err
+}
+
+// Reads one byte at a time from a reader
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	_, err := io.ReadFull(b.r, buf[:])
+	return buf[0], err
+}
@@ -0,0 +1,121 @@
+package fnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// A connection reading from a fixed buffer, sent messages are discarded
+type readerConn struct {
+	r    io.Reader
+	open bool
+}
+
+func newReaderConn(data []byte) *readerConn {
+	return &readerConn{r: bytes.NewReader(data), open: true}
+}
+
+func (c *readerConn) Send(b []byte) error { return nil }
+func (c *readerConn) Read(buf []byte) error {
+	_, err := io.ReadFull(c.r, buf)
+	return err
+}
+func (c *readerConn) Kind() string { return "reader" }
+func (c *readerConn) Close()       { c.open = false }
+func (c *readerConn) Run()         {}
+func (c *readerConn) Open() bool   { return c.open }
+func (c *readerConn) IP() string   { return "" }
+
+// Encodes a header with codec followed by payload
+func wireMessage(codec FrameCodec, evtId, length int32, payload []byte) []byte {
+	return append(codec.AppendHeader(nil, Header{Event: evtId, Length: length}), payload...)
+}
+
+func TestReadFrameLengths(t *testing.T) {
+	for _, codec := range []FrameCodec{DefaultFrameCodec, VarintCodec{}} {
+		tests := []struct {
+			name string
+			data []byte
+			err  error
+		}{
+			{"valid", wireMessage(codec, 1, 3, []byte("abc")), nil},
+			{"empty", wireMessage(codec, 1, 0, nil), nil},
+			{"negative", wireMessage(codec, 1, -1, nil), ErrInvalidLength},
+			{"too large", wireMessage(codec, 1, DefaultMaxPayloadSize+1, nil), ErrPayloadTooLarge},
+			{"truncated payload", wireMessage(codec, 1, 10, []byte("abc")), io.ErrUnexpectedEOF},
+			{"truncated header", wireMessage(codec, 1000, 1000, nil)[:2], io.ErrUnexpectedEOF},
+		}
+
+		for _, test := range tests {
+			e := DefaultEngine()
+			e.FrameCodec = codec
+			f, err := e.readFrame(NewSession(newReaderConn(test.data)))
+			if err != test.err {
+				t.Errorf("%T %s: got error %v, expected %v", codec, test.name, err, test.err)
+				continue
+			}
+			if err == nil {
+				f.release()
+			}
+		}
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	for _, varint := range []bool{false, true} {
+		var codec FrameCodec = DefaultFrameCodec
+		if varint {
+			codec = VarintCodec{}
+		}
+		f.Add(wireMessage(codec, 1, 3, []byte("abc")), varint)
+		f.Add(wireMessage(codec, 1, -1, nil), varint)
+		f.Add(wireMessage(codec, -1<<31, 1<<31-1, nil), varint)
+		f.Add(wireMessage(codec, 1, 10, []byte("abc")), varint)
+		f.Add(wireMessage(codec, 1000, 1000, nil)[:2], varint)
+		f.Add(wireMessage(codec, EvtChecksum, 4, []byte{1, 2, 3, 4}), varint)
+	}
+	request := binary.LittleEndian.AppendUint32(nil, 1)
+	request = append(request, wireMessage(DefaultFrameCodec, 1, 2, []byte("{}"))...)
+	f.Add(wireMessage(DefaultFrameCodec, EvtRequest, int32(len(request)), request), false)
+	f.Add(wireMessage(DefaultFrameCodec, EvtDeadlineRequest, 4, []byte{1, 0, 0, 0}), false)
+	fragment := append([]byte{1, 0, 0, 0, fragmentFirst | fragmentLast, 1, 0, 0, 0}, "{}"...)
+	f.Add(wireMessage(DefaultFrameCodec, EvtFragment, int32(len(fragment)), fragment), false)
+	f.Add(wireMessage(DefaultFrameCodec, EvtError, 6, []byte{1, 0, 0, 0, 2, 0}), false)
+	// A varint length that doesn't fit in an int32
+	f.Add(binary.AppendUvarint(binary.AppendVarint(nil, 1), 1<<40), true)
+
+	f.Fuzz(func(t *testing.T, data []byte, varint bool) {
+		e := DefaultEngine()
+		e.MaxPayloadSize = 1 << 16
+		if varint {
+			e.FrameCodec = VarintCodec{}
+		}
+
+		e.Encoder = JsonEncoder{}
+		e.OnPeerError = func(session Session, err *Error) {}
+		e.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) (*testMsg, error) {
+			return &msg, nil
+		}, 1))
+
+		// Handles the messages like HandleConn would, so the control messages wrapping others are parsed aswell
+		session := NewSession(newReaderConn(data))
+		session.state.setEngine(e)
+		close(session.state.ready)
+		for {
+			err := e.readMessage(session)
+			if _, ok := err.(*PanicError); ok {
+				t.Fatal(err)
+			}
+			if err != nil && !isMessageError(err) {
+				break
+			}
+		}
+
+		f, err := e.parseFrame(data)
+		if err == nil && len(f.payload) > len(data) {
+			t.Fatalf("parsed %d bytes of payload from %d bytes", len(f.payload), len(data))
+		}
+	})
+}
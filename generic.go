@@ -0,0 +1,94 @@
+package fnet
+
+import (
+	"context"
+	"reflect"
+)
+
+// Set on handlers created with Handle and HandleRequest, used instead of reflection
+type typedHandler struct {
+	decode func(e *Engine, session Session, payload []byte) (interface{}, error)
+	call   func(ctx context.Context, session Session, envelope *Message, msg interface{}) (interface{}, error)
+}
+
+// Creates a handler for evt calling callback, the payload is decoded into a new T for every message
+// Unlike NewHandler this is checked at compile time and doesn't use reflection to decode or call the handler
+// Add it with Engine.AddHandler, fields like MaxConcurrent can be set before that
+// An error returned by callback is reported as a *HandlerError
+func Handle[T any](evt int32, callback func(Session, *T) error) Handler {
+	return handle(evt, callback, false, func(ctx context.Context, session Session, envelope *Message, msg *T) error {
+		return callback(session, msg)
+	})
+}
+
+// Same as Handle but callback also gets the context and the *Message describing the received message, like handlers taking them with NewHandler
+func HandleContext[T any](evt int32, callback func(context.Context, Session, *Message, *T) error) Handler {
+	return handle(evt, callback, true, callback)
+}
+
+func handle[T any](evt int32, original interface{}, full bool, callback func(context.Context, Session, *Message, *T) error) Handler {
+	return Handler{
+		CallBack:     original,
+		Event:        evt,
+		DataType:     reflect.TypeOf((*T)(nil)).Elem(),
+		envelope:     full,
+		takesContext: full,
+		typed: &typedHandler{
+			decode: decode[T],
+			call: func(ctx context.Context, session Session, envelope *Message, msg interface{}) (interface{}, error) {
+				err := callback(ctx, session, envelope, msg.(*T))
+				if err != nil {
+					return nil, &HandlerError{Event: evt, Err: err}
+				}
+				return nil, nil
+			},
+		},
+	}
+}
+
+// Same as Handle but for request handlers, the response is sent back to the peer if it's not nil
+func HandleRequest[Req, Resp any](evt int32, callback func(Session, *Req) (*Resp, error)) Handler {
+	return handleRequest(evt, callback, false, func(ctx context.Context, session Session, envelope *Message, req *Req) (*Resp, error) {
+		return callback(session, req)
+	})
+}
+
+// Same as HandleRequest but callback also gets the context and the *Message, the context has the caller's deadline if it sent one
+func HandleRequestContext[Req, Resp any](evt int32, callback func(context.Context, Session, *Message, *Req) (*Resp, error)) Handler {
+	return handleRequest(evt, callback, true, callback)
+}
+
+func handleRequest[Req, Resp any](evt int32, original interface{}, full bool, callback func(context.Context, Session, *Message, *Req) (*Resp, error)) Handler {
+	return Handler{
+		CallBack:     original,
+		Event:        evt,
+		DataType:     reflect.TypeOf((*Req)(nil)).Elem(),
+		envelope:     full,
+		takesContext: full,
+		typed: &typedHandler{
+			decode: decode[Req],
+			call: func(ctx context.Context, session Session, envelope *Message, msg interface{}) (interface{}, error) {
+				resp, err := callback(ctx, session, envelope, msg.(*Req))
+				if err != nil {
+					return nil, &HandlerError{Event: evt, Err: err}
+				}
+				if resp == nil {
+					return nil, nil
+				}
+				return resp, nil
+			},
+		},
+	}
+}
+
+// Decodes payload into a new T with the session's encoder
+func decode[T any](e *Engine, session Session, payload []byte) (interface{}, error) {
+	msg := new(T)
+	if len(payload) > 0 {
+		err := e.encoder(session).Unmarshal(payload, msg)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,47 @@
+package fnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypedHandlerFields(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Dispatch = DispatchConcurrent
+	started, release := make(chan string, 2), make(chan bool)
+	handler := Handle(1, func(session Session, msg *testMsg) error {
+		started <- msg.Text
+		<-release
+		return nil
+	})
+	handler.MaxConcurrent = 1
+	if err := srv.AddHandler(handler); err != nil {
+		t.Fatal(err)
+	}
+	_, cs := connect(t, srv, cli)
+
+	cli.CreateAndSend(cs, 1, testMsg{Text: "a"})
+	cli.CreateAndSend(cs, 1, testMsg{Text: "b"})
+	receive(t, started)
+	select {
+	case <-started:
+		t.Fatal("MaxConcurrent of the typed handler ignored")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	receive(t, started)
+	release <- true
+
+	replaced := make(chan string, 1)
+	err := srv.ReplaceHandler(HandleRequest(1, func(session Session, req *testMsg) (*testMsg, error) {
+		replaced <- req.Text
+		return nil, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.CreateAndSend(cs, 1, testMsg{Text: "c"})
+	if text := receive(t, replaced); text != "c" {
+		t.Fatalf("got %q, expected %q", text, "c")
+	}
+}
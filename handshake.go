@@ -0,0 +1,243 @@
+package fnet
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The protocol version implemented by this package
+const ProtocolVersion int32 = 1
+
+// Reserved event id's used in the handshake
+const (
+	EvtHello  int32 = -3 // Payload is a json encoded Hello
+	EvtAccept int32 = -4 // Sent after receiving the peers hello if it was accepted
+	EvtReject int32 = -5 // Sent instead of EvtAccept, payload is the reason the peer was rejected
+)
+
+// Optional features supported by a peer
+type Features uint32
+
+const (
+	FeatureRequests  Features = 1 << iota // Request/response messages
+	FeatureChecksum                       // Messages with a crc32 checksum
+	FeatureFragments                      // Messages split into fragments
+	FeatureHeartbeat                      // Responds to pings
+	FeatureErrors                         // Handles error messages
+	FeatureCancel                         // Handles request deadlines and cancel messages
+)
+
+// All the features implemented by this package
+const AllFeatures = FeatureRequests | FeatureChecksum | FeatureFragments | FeatureHeartbeat | FeatureErrors | FeatureCancel
+
+// Sent by both peers right after the connection is opened
+type Hello struct {
+	Version     int32    `json:"version"`
+	Encoders    []string `json:"encoders,omitempty"`    // Names of the supported encoders, in order of preference
+	Compression []string `json:"compression,omitempty"` // Names of the supported compression algorithms, in order of preference
+	Features    Features `json:"features"`
+}
+
+// The result of a handshake
+type Negotiated struct {
+	Peer        Hello    // The hello the peer sent
+	Version     int32    // The lowest version of the two peers
+	Encoder     string   // Name of the encoder used, empty if Engine.Encoder is used
+	Compression string   // Name of the compression algorithm used, empty for none
+	Features    Features // Features supported by both peers
+}
+
+// Handshake configuration
+type Handshake struct {
+	// What's sent to the peer, Version defaults to ProtocolVersion and Features to AllFeatures
+	Hello Hello
+
+	// Close connections to peers that don't send a hello
+	// Otherwise those are treated as peers that don't support any handshake features
+	Required bool
+
+	// Peers with a lower version are rejected
+	MinVersion int32
+
+	// Called with the peers hello after the rest of the negotiation succeeded
+	// Returning an error rejects the peer, the error message is sent to it as the reason
+	Accept func(session Session, negotiated *Negotiated) error
+}
+
+// Returned when the peer rejected us in the handshake
+type RejectError struct {
+	Reason string
+}
+
+func (r *RejectError) Error() string {
+	return "Rejected by peer: " + r.Reason
+}
+
+func rejectError(payload []byte) error {
+	return &RejectError{Reason: string(payload)}
+}
+
+// Exchanges hellos with the peer and stores the result in session
+// If the peer didn't send a hello its first message is returned so it can be handled normally
+func (e *Engine) handshake(session Session) (*frame, error) {
+	defer close(session.state.ready)
+
+	hello := e.Handshake.Hello
+	if hello.Version == 0 {
+		hello.Version = ProtocolVersion
+	}
+	if hello.Features == 0 {
+		hello.Features = AllFeatures
+	}
+
+	encoded, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+	wireMessage, err := e.createWireMessage(EvtHello, encoded)
+	if err != nil {
+		return nil, err
+	}
+	err = SendPriority(session.Conn, wireMessage, PriorityControl)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := e.readFrame(session)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first.evtId {
+	case EvtReject:
+		defer first.release()
+		return nil, rejectError(first.payload)
+	case EvtHello:
+	default:
+		if e.Handshake.Required {
+			first.release()
+			return nil, e.reject(session, "Handshake required")
+		}
+		// Old peers don't know about any of the features, so they're never sent control messages they can't handle
+		session.state.negotiated = &Negotiated{}
+		return &first, nil
+	}
+
+	var peer Hello
+	err = json.Unmarshal(first.payload, &peer)
+	first.release()
+	if err != nil {
+		return nil, e.reject(session, "Malformed hello")
+	}
+
+	negotiated, reason := negotiate(hello, peer)
+	if reason == "" && peer.Version < e.Handshake.MinVersion {
+		reason = fmt.Sprintf("Version %d is not supported, at least %d is required", peer.Version, e.Handshake.MinVersion)
+	}
+	if reason == "" && e.Handshake.Accept != nil {
+		if err := e.Handshake.Accept(session, negotiated); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		return nil, e.reject(session, reason)
+	}
+
+	wireMessage, err = e.createWireMessage(EvtAccept, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = SendPriority(session.Conn, wireMessage, PriorityControl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the peer to accept us aswell
+	verdict, err := e.readFrame(session)
+	if err != nil {
+		return nil, err
+	}
+	defer verdict.release()
+	switch verdict.evtId {
+	case EvtAccept:
+	case EvtReject:
+		return nil, rejectError(verdict.payload)
+	default:
+		return nil, ErrMalformedMessage
+	}
+
+	session.state.negotiated = negotiated
+	if negotiated.Encoder != "" {
+		session.state.encoder, _ = GetEncoder(negotiated.Encoder)
+		session.state.encoderName = negotiated.Encoder
+	}
+	if negotiated.Compression != "" {
+		session.state.compressor, _ = GetCompressor(negotiated.Compression)
+	}
+	return nil, nil
+}
+
+// Blocks until the handshake on session is done, if the engine uses handshakes
+// Messages can't be sent before that since the encoder and features aren't known yet
+func (e *Engine) waitHandshake(session Session) {
+	if e.Handshake != nil && session.state != nil {
+		<-session.state.ready
+	}
+}
+
+// Sends the reason to the peer and returns it as an error
+func (e *Engine) reject(session Session, reason string) error {
+	wireMessage, err := e.createWireMessage(EvtReject, []byte(reason))
+	if err == nil {
+		SendPriority(session.Conn, wireMessage, PriorityControl)
+	}
+	return fmt.Errorf("Rejected peer: %s", reason)
+}
+
+// Negotiates the settings of 2 hellos, the result is the same no matter which of them is ours
+// Returns a reason if they're incompatible
+func negotiate(ours, theirs Hello) (*Negotiated, string) {
+	negotiated := &Negotiated{
+		Peer:     theirs,
+		Version:  ours.Version,
+		Features: ours.Features & theirs.Features,
+	}
+	if theirs.Version < negotiated.Version {
+		negotiated.Version = theirs.Version
+	}
+
+	// If either didn't specify any encoders they're both assumed to use the same one
+	if len(ours.Encoders) > 0 && len(theirs.Encoders) > 0 {
+		negotiated.Encoder = pickCommon(ours.Encoders, theirs.Encoders, func(name string) bool {
+			_, found := GetEncoder(name)
+			return found
+		})
+		if negotiated.Encoder == "" {
+			return nil, "No common encoder"
+		}
+	}
+
+	negotiated.Compression = pickCommon(ours.Compression, theirs.Compression, func(name string) bool {
+		_, found := GetCompressor(name)
+		return found
+	})
+	return negotiated, ""
+}
+
+// Picks the name in both a and b with the best combined rank, ties are broken by the name
+func pickCommon(a, b []string, available func(string) bool) string {
+	best := ""
+	bestRank := -1
+	for i, name := range a {
+		for j, other := range b {
+			if name != other || !available(name) {
+				continue
+			}
+			if bestRank == -1 || i+j < bestRank || (i+j == bestRank && name < best) {
+				best = name
+				bestRank = i + j
+			}
+		}
+	}
+	return best
+}
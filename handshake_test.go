@@ -0,0 +1,193 @@
+package fnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// Connects srv and cli and returns what each of them negotiated, fails the test if the handshake failed
+func handshake(t *testing.T, srv, cli *Engine) (Session, Session, *Negotiated, *Negotiated) {
+	t.Helper()
+	opened := make(chan Session, 2)
+	srv.OnConnOpen = func(session Session) { opened <- session }
+	cli.OnConnOpen = srv.OnConnOpen
+	ss, cs := connect(t, srv, cli)
+	receive(t, opened)
+	receive(t, opened)
+	return ss, cs, ss.Negotiated(), cs.Negotiated()
+}
+
+func TestHandshake(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Handshake = &Handshake{Hello: Hello{Encoders: []string{"proto", "json"}}}
+	cli.Handshake = &Handshake{Hello: Hello{Encoders: []string{"json"}, Features: FeatureRequests}}
+	srv.AddHandler(NewHandlerSafe(func(session Session, req testMsg) (*testMsg, error) {
+		return &testMsg{Text: req.Text + "!"}, nil
+	}, 1))
+
+	_, cs, srvNegotiated, cliNegotiated := handshake(t, srv, cli)
+	for _, negotiated := range []*Negotiated{srvNegotiated, cliNegotiated} {
+		if negotiated == nil {
+			t.Fatal("nothing negotiated")
+		}
+		if negotiated.Version != ProtocolVersion || negotiated.Encoder != "json" || negotiated.Features != FeatureRequests {
+			t.Fatalf("%+v", negotiated)
+		}
+	}
+	if srvNegotiated.Peer.Encoders[0] != "json" || cliNegotiated.Peer.Encoders[0] != "proto" {
+		t.Fatal("peer hellos were swapped")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var resp testMsg
+	if err := cli.Call(ctx, cs, 1, testMsg{Text: "a"}, &resp); err != nil || resp.Text != "a!" {
+		t.Fatal(err, resp)
+	}
+}
+
+func TestHandshakeReject(t *testing.T) {
+	tests := []struct {
+		name string
+		srv  Handshake
+		cli  Handshake
+	}{
+		{"min version", Handshake{MinVersion: ProtocolVersion + 1}, Handshake{}},
+		{"no common encoder", Handshake{Hello: Hello{Encoders: []string{"proto"}}}, Handshake{Hello: Hello{Encoders: []string{"json"}}}},
+		{"accept", Handshake{Accept: func(session Session, negotiated *Negotiated) error {
+			return errors.New("Not allowed")
+		}}, Handshake{}},
+	}
+
+	for _, test := range tests {
+		srv, cli := newEngines()
+		srv.Handshake, cli.Handshake = &test.srv, &test.cli
+		opened := make(chan Session, 2)
+		srv.OnConnOpen = func(session Session) { opened <- session }
+		cli.OnConnOpen = srv.OnConnOpen
+
+		ss, cs := connect(t, srv, cli)
+		// Both sides close the connection without handling it
+		receive(t, ss.Conn.(*pipeConn).closed)
+		receive(t, cs.Conn.(*pipeConn).closed)
+		if len(opened) != 0 {
+			t.Errorf("%s: connection was opened", test.name)
+		}
+	}
+}
+
+// Peers from before the handshake don't send a hello and ignore ours
+func TestHandshakeOldPeer(t *testing.T) {
+	for _, required := range []bool{false, true} {
+		srv, _ := newEngines()
+		srv.Handshake = &Handshake{Required: required}
+		received := make(chan testMsg, 1)
+		srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+			received <- msg
+		}, 1))
+		go srv.ListenChannels()
+
+		a, b := newPipe()
+		defer b.Close()
+		go srv.HandleConn(NewSession(a))
+		go io.Copy(io.Discard, b.conn)
+		b.Run()
+
+		wireMessage, err := srv.CreateWireMessage(1, testMsg{Text: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Send(wireMessage)
+
+		if required {
+			receive(t, a.closed)
+			if len(received) != 0 {
+				t.Error("message from a peer without a hello was handled")
+			}
+		} else if msg := receive(t, received); msg.Text != "a" {
+			t.Error(msg)
+		}
+	}
+}
+
+func TestHandshakeOldPeerFeatures(t *testing.T) {
+	srv, _ := newEngines()
+	srv.Handshake = &Handshake{}
+	srv.Checksum = true
+	srv.Heartbeat = &Heartbeat{Interval: 10 * time.Millisecond, MaxMissed: 2}
+	opened := make(chan Session, 1)
+	srv.OnConnOpen = func(session Session) { opened <- session }
+	go srv.ListenChannels()
+
+	a, b := newPipe()
+	defer b.Close()
+	go srv.HandleConn(NewSession(a))
+	b.Run()
+	old := NewSession(b)
+
+	// The hello is ignored by the old peer
+	if f, err := srv.readFrame(old); err != nil || f.evtId != EvtHello {
+		t.Fatal("expected a hello", err)
+	}
+	wireMessage, err := srv.CreateWireMessage(1, testMsg{Text: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Send(wireMessage)
+	ss := receive(t, opened)
+
+	if n := ss.Negotiated(); n == nil || n.Version != 0 || n.Features != 0 {
+		t.Fatalf("got %+v, expected nothing negotiated", n)
+	}
+	for _, feature := range []Features{FeatureRequests, FeatureChecksum, FeatureFragments, FeatureHeartbeat, FeatureErrors} {
+		if ss.Supports(feature) {
+			t.Errorf("old peer supports feature %d", feature)
+		}
+	}
+
+	// No checksums or pings, and not closed for not answering them
+	time.Sleep(50 * time.Millisecond)
+	if err := srv.CreateAndSend(ss, 1, testMsg{Text: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := srv.readFrame(old)
+	if err != nil || f.evtId != 1 {
+		t.Fatalf("got event %d %v, expected the plain message", f.evtId, err)
+	}
+}
+
+func TestHandshakeMixedConfig(t *testing.T) {
+	srv, cli := newEngines()
+	srv.Handshake = &Handshake{}
+	received := make(chan testMsg, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	cli.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	opened := make(chan Session, 1)
+	srv.OnConnOpen = func(session Session) { opened <- session }
+	_, cs := connect(t, srv, cli)
+
+	// The client without a handshake ignores the hello and is treated as an old peer
+	if err := cli.CreateAndSend(cs, 1, testMsg{Text: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, received); msg.Text != "a" {
+		t.Fatalf("got %q, expected %q", msg.Text, "a")
+	}
+	ss := receive(t, opened)
+	if err := srv.CreateAndSend(ss, 1, testMsg{Text: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, received); msg.Text != "b" {
+		t.Fatalf("got %q, expected %q", msg.Text, "b")
+	}
+	if !cs.Conn.Open() || !ss.Conn.Open() {
+		t.Fatal("connection closed")
+	}
+}
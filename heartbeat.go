@@ -0,0 +1,96 @@
+package fnet
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// Reserved event id's used by the heartbeat
+// The payload of a ping is the time it was sent in unix nanoseconds, a pong echoes the payload of the ping
+const (
+	EvtPing int32 = -9
+	EvtPong int32 = -10
+)
+
+// Time between pings if Heartbeat.Interval isn't set
+const DefaultHeartbeatInterval = 30 * time.Second
+
+// Heartbeat configuration
+type Heartbeat struct {
+	Interval time.Duration // Time between pings, DefaultHeartbeatInterval if 0
+	// The session is closed if this many pings in a row were not answered
+	// Pings aren't counted while a message is handled on the reading goroutine, e.g. a handler with DispatchInline,
+	// so a peer that dies during a long handler is only noticed after it returns
+	MaxMissed int
+}
+
+// Pings the peer every interval until the session is closed, closing it if the peer stops responding
+func (e *Engine) heartbeat(session Session) {
+	interval := e.Heartbeat.Interval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&session.state.handling) == 0 {
+				missed := atomic.AddInt32(&session.state.missedPings, 1) - 1
+				if e.Heartbeat.MaxMissed > 0 && int(missed) >= e.Heartbeat.MaxMissed {
+					session.state.setClose(CloseInfo{Cause: CauseHeartbeatTimeout, Code: CloseAbnormal, Err: ErrTimeout})
+					session.Conn.Close()
+					return
+				}
+			}
+
+			payload := make([]byte, 8)
+			binary.LittleEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+			wireMessage, err := e.createWireMessage(EvtPing, payload)
+			if err == nil {
+				err = e.sendPriority(session, wireMessage, PriorityControl)
+			}
+			if err != nil {
+				// The connection failed, with DispatchInline the reading goroutine may be stuck in a handler
+				// and wouldn't notice, so the handler's context is cancelled here
+				session.state.cancel()
+				return
+			}
+		case <-session.state.done:
+			return
+		}
+	}
+}
+
+func (e *Engine) handlePing(payload []byte, session Session) error {
+	wireMessage, err := e.createWireMessage(EvtPong, payload)
+	if err != nil {
+		return err
+	}
+	return e.sendPriority(session, wireMessage, PriorityControl)
+}
+
+func (e *Engine) handlePong(payload []byte, session Session) error {
+	if len(payload) != 8 {
+		return ErrMalformedMessage
+	}
+	atomic.StoreInt32(&session.state.missedPings, 0)
+
+	sent := int64(binary.LittleEndian.Uint64(payload))
+	sample := time.Now().UnixNano() - sent
+	if sample < 0 {
+		return nil
+	}
+
+	// Smoothed the same way as tcp does, rtt = 7/8 rtt + 1/8 sample
+	rtt := atomic.LoadInt64(&session.state.rtt)
+	if rtt == 0 {
+		rtt = sample
+	} else {
+		rtt += (sample - rtt) / 8
+	}
+	atomic.StoreInt64(&session.state.rtt, rtt)
+	return nil
+}
@@ -0,0 +1,40 @@
+package fnet
+
+// Calls the next interceptor, or the handler if it's the last one
+// msg is the decoded message, nil if the handler doesn't take one, and the response is nil unless it's a request handler
+type Invoker func(session Session, evtId int32, msg interface{}) (response interface{}, err error)
+
+// Wraps the dispatch of every message to its handler
+// Interceptors can inspect or replace the message and the result, or return an error without calling next
+type Interceptor func(session Session, evtId int32, msg interface{}, next Invoker) (response interface{}, err error)
+
+// Sends a message, or calls the next outbound interceptor
+type SendInvoker func(session Session, evtId int32, data interface{}) error
+
+// Wraps CreateAndSend, CreateAndSendPriority and CreateAndBroadcast
+// session is the zero Session for broadcasts
+type SendInterceptor func(session Session, evtId int32, data interface{}, next SendInvoker) error
+
+// Adds interceptors wrapping the dispatch of received messages, the first one added is the outermost
+// Has to be called before any connections are handled
+func (e *Engine) Use(interceptors ...Interceptor) {
+	e.interceptors = append(e.interceptors, interceptors...)
+}
+
+// Adds interceptors wrapping messages sent with CreateAndSend and CreateAndBroadcast, the first one added is the outermost
+// Has to be called before any messages are sent
+func (e *Engine) UseOutbound(interceptors ...SendInterceptor) {
+	e.sendInterceptors = append(e.sendInterceptors, interceptors...)
+}
+
+// Calls send through the outbound interceptors
+func (e *Engine) intercept(session Session, evtId int32, data interface{}, send SendInvoker) error {
+	next := send
+	for i := len(e.sendInterceptors) - 1; i >= 0; i-- {
+		interceptor, inner := e.sendInterceptors[i], next
+		next = func(session Session, evtId int32, data interface{}) error {
+			return interceptor(session, evtId, data, inner)
+		}
+	}
+	return next(session, evtId, data)
+}
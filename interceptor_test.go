@@ -0,0 +1,123 @@
+package fnet
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Records the order interceptors and handlers are called in
+type callLog struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(call string) {
+	l.lock.Lock()
+	l.calls = append(l.calls, call)
+	l.lock.Unlock()
+}
+
+func (l *callLog) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return strings.Join(l.calls, " ")
+}
+
+func logging(log *callLog, name string) Interceptor {
+	return func(session Session, evtId int32, msg interface{}, next Invoker) (interface{}, error) {
+		log.add(name + ">")
+		resp, err := next(session, evtId, msg)
+		log.add("<" + name)
+		return resp, err
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	srv, cli := newEngines()
+	log := new(callLog)
+	srv.Use(logging(log, "a"), logging(log, "b"))
+	srv.Use(func(session Session, evtId int32, msg interface{}, next Invoker) (interface{}, error) {
+		if evtId == 2 {
+			if msg.(testMsg).Text == "plain" {
+				return nil, errors.New("Denied")
+			}
+			return nil, Errorf(StatusPermissionDenied, "denied")
+		}
+		// Replace the message and the response
+		resp, err := next(session, evtId, testMsg{Text: msg.(testMsg).Text + "?"})
+		if resp != nil {
+			resp = &testMsg{Text: resp.(*testMsg).Text + "!"}
+		}
+		return resp, err
+	})
+
+	received := make(chan testMsg, 1)
+	srv.AddHandlers(NewHandlerSafe(func(session Session, msg testMsg) {
+		log.add("handler")
+		received <- msg
+	}, 1), NewHandlerSafe(func(session Session, msg testMsg) {
+		t.Error("interceptor didn't stop the message")
+	}, 2), NewHandlerSafe(func(session Session, msg testMsg) (*testMsg, error) {
+		return &testMsg{Text: msg.Text}, nil
+	}, 3))
+	peerErrors := make(chan *Error, 1)
+	cli.OnPeerError = func(session Session, err *Error) {
+		peerErrors <- err
+	}
+	_, cs := connect(t, srv, cli)
+
+	cli.CreateAndSend(cs, 1, testMsg{Text: "a"})
+	if msg := receive(t, received); msg.Text != "a?" {
+		t.Fatalf("got %q, expected %q", msg.Text, "a?")
+	}
+
+	cli.CreateAndSend(cs, 2, testMsg{})
+	if err := receive(t, peerErrors); err.Code != StatusPermissionDenied {
+		t.Fatalf("got %v, expected a permission denied error", err)
+	}
+	// Other errors only affect the message aswell
+	cli.CreateAndSend(cs, 2, testMsg{Text: "plain"})
+	if err := receive(t, peerErrors); err.Code != StatusUnknown || err.Message != "Denied" {
+		t.Fatalf("got %v, expected an unknown error", err)
+	}
+
+	resp := new(testMsg)
+	if err := cli.Call(context.Background(), cs, 3, testMsg{Text: "b"}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "b?!" {
+		t.Fatalf("got %q, expected %q", resp.Text, "b?!")
+	}
+
+	// The first interceptor added is the outermost one
+	expected := "a> b> handler <b <a a> b> <b <a a> b> <b <a a> b> <b <a"
+	if s := log.String(); s != expected {
+		t.Fatalf("got %q, expected %q", s, expected)
+	}
+}
+
+func TestOutboundInterceptors(t *testing.T) {
+	srv, cli := newEngines()
+	received := make(chan testMsg, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+
+	suffix := func(s string) SendInterceptor {
+		return func(session Session, evtId int32, data interface{}, next SendInvoker) error {
+			return next(session, evtId, testMsg{Text: data.(testMsg).Text + s})
+		}
+	}
+	cli.UseOutbound(suffix("a"), suffix("b"))
+	_, cs := connect(t, srv, cli)
+
+	if err := cli.CreateAndSend(cs, 1, testMsg{Text: "-"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, received); msg.Text != "-ab" {
+		t.Fatalf("got %q, expected %q", msg.Text, "-ab")
+	}
+}
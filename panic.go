@@ -0,0 +1,63 @@
+package fnet
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// What happens to a session when one of its messages made a handler panic
+type PanicPolicy int
+
+const (
+	PanicCloseSession PanicPolicy = iota // Close the session with CloseInternalError
+	PanicContinue                        // Keep handling the session's messages
+)
+
+// Returned when a handler panicked, the panic is recovered and reported to Engine.OnPanic or on Engine.ErrChan
+type PanicError struct {
+	Event int32
+	Value interface{} // The value passed to panic
+	Stack []byte      // Stack trace of the goroutine that panicked
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("Handler for event %d panicked: %v\n%s", p.Event, p.Value, p.Stack)
+}
+
+// Recovers a panic in a handler, sets err to a *PanicError if there was one
+func (e *Engine) recoverHandler(session Session, evtId int32, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	panicErr := &PanicError{Event: evtId, Value: r, Stack: debug.Stack()}
+	*err = panicErr
+	if e.OnPanic != nil {
+		e.OnPanic(session, panicErr)
+		return
+	}
+
+	// A handler that keeps panicking would pile up blocked senders if nothing receives from ErrChan
+	select {
+	case e.ErrChan <- panicErr:
+	default:
+		fmt.Println("Error: ", panicErr)
+	}
+}
+
+// Applies Engine.PanicPolicy if err is a *PanicError, returns true if the session was closed
+func (e *Engine) panicked(session Session, err error) bool {
+	panicErr, ok := err.(*PanicError)
+	if !ok || e.PanicPolicy != PanicCloseSession {
+		return false
+	}
+
+	e.closeSession(session, CloseInfo{
+		Cause:  CauseHandlerPanic,
+		Code:   CloseInternalError,
+		Reason: "Internal error",
+		Err:    panicErr,
+	})
+	return true
+}
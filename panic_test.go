@@ -0,0 +1,63 @@
+package fnet
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestPanicReporting(t *testing.T) {
+	e := DefaultEngine()
+	e.PanicPolicy = PanicContinue
+	handler, err := NewHandler(func(session Session) { panic("boom") }, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession(newReaderConn(nil))
+
+	// Nothing receives from ErrChan, which used to leave a blocked goroutine behind for every panic
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		_, err := e.dispatch(nil, handler, session, nil, nil)
+		if _, ok := err.(*PanicError); !ok {
+			t.Fatal(err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines left behind", after-before)
+	}
+
+	var reported *PanicError
+	e.OnPanic = func(s Session, err *PanicError) {
+		reported = err
+	}
+	e.dispatch(nil, handler, session, nil, nil)
+	if reported == nil || reported.Value != "boom" || reported.Event != 1 {
+		t.Fatal(reported)
+	}
+}
+
+func TestNotFoundPanic(t *testing.T) {
+	srv, cli := DefaultEngine(), DefaultEngine()
+	srv.NotFound = func(session Session, evtId int32, payload []byte) error {
+		panic("boom")
+	}
+	panics := make(chan *PanicError, 1)
+	srv.OnPanic = func(s Session, err *PanicError) {
+		panics <- err
+	}
+	closed := make(chan CloseInfo, 1)
+	srv.OnConnClose = func(session Session, info CloseInfo) {
+		closed <- info
+	}
+
+	_, cs := connect(t, srv, cli)
+	if err := cli.CreateAndSend(cs, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, panics); err.Event != 1 {
+		t.Fatal(err)
+	}
+	if info := receive(t, closed); info.Cause != CauseHandlerPanic {
+		t.Fatal(info)
+	}
+}
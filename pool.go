@@ -0,0 +1,55 @@
+package fnet
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Pooled payload buffers come in power of two sizes from 64 bytes to 64KB, bigger payloads are allocated normally
+const (
+	minPooledShift = 6
+	maxPooledShift = 16
+)
+
+var bufferPools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+// Returns the index of the pool with buffers of at least size bytes, -1 if it's too big to be pooled
+func poolIndex(size int) int {
+	shift := bits.Len(uint(size - 1))
+	if shift < minPooledShift {
+		shift = minPooledShift
+	}
+	if shift > maxPooledShift {
+		return -1
+	}
+	return shift - minPooledShift
+}
+
+// Returns a buffer of size bytes, it should be returned with putBuffer when it's no longer used
+func getBuffer(size int) *[]byte {
+	index := poolIndex(size)
+	if index < 0 {
+		buf := make([]byte, size)
+		return &buf
+	}
+
+	if buf, ok := bufferPools[index].Get().(*[]byte); ok {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	buf := make([]byte, size, 1<<uint(index+minPooledShift))
+	return &buf
+}
+
+// Returns a buffer from getBuffer to its pool
+func putBuffer(buf *[]byte) {
+	if buf == nil {
+		return
+	}
+
+	index := poolIndex(cap(*buf))
+	if index < 0 || cap(*buf) != 1<<uint(index+minPooledShift) {
+		return
+	}
+	bufferPools[index].Put(buf)
+}
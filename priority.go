@@ -0,0 +1,135 @@
+package fnet
+
+import (
+	"time"
+)
+
+// The priority of an outgoing message, connections implementing PrioritySender write higher priorities first
+type Priority int
+
+const (
+	PriorityControl Priority = iota // Control messages like pongs and close messages
+	PriorityHigh
+	PriorityNormal // Used by Connection.Send
+	PriorityBulk
+
+	numPriorities = 4
+)
+
+// Optionally implemented by connections that can write messages out of order based on their priority
+type PrioritySender interface {
+	SendPriority(b []byte, priority Priority) error
+}
+
+// Sends b with priority if conn supports it, otherwise it's sent normally
+func SendPriority(conn Connection, b []byte, priority Priority) error {
+	if sender, ok := conn.(PrioritySender); ok {
+		return sender.SendPriority(b, priority)
+	}
+	return conn.Send(b)
+}
+
+// How many messages are taken from each queue per round before lower priorities get a turn
+var priorityWeights = [numPriorities]int{16, 8, 4, 1}
+
+// A send queue with a queue for every priority, for use in a connection's writer
+// Higher priorities are written first, but every queue with messages is served at least once per round
+// Push can be called from any goroutine, everything else only from the writer
+type SendQueue struct {
+	queues  [numPriorities]chan []byte
+	notify  chan struct{} // Signaled when a message is pushed
+	credits [numPriorities]int
+}
+
+// Creates a queue holding up to size messages per priority
+func NewSendQueue(size int) *SendQueue {
+	q := &SendQueue{
+		notify:  make(chan struct{}, 1),
+		credits: priorityWeights,
+	}
+	for i := range q.queues {
+		q.queues[i] = make(chan []byte, size)
+	}
+	return q
+}
+
+// Queues b, blocking while the queue for priority is full
+// Returns ErrSendTimeout if that took longer than timeout and ErrConnClosed if closed was closed first
+func (q *SendQueue) Push(b []byte, priority Priority, timeout time.Duration, closed <-chan struct{}) error {
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityNormal
+	}
+
+	select {
+	case q.queues[priority] <- b:
+	default:
+		after := time.NewTimer(timeout)
+		defer after.Stop()
+		select {
+		case q.queues[priority] <- b:
+		case <-closed:
+			return ErrConnClosed
+		case <-after.C:
+			return ErrSendTimeout
+		}
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Returns the next message to write without blocking, false if nothing is queued
+func (q *SendQueue) Pop() ([]byte, bool) {
+	for round := 0; round < 2; round++ {
+		for i := range q.queues {
+			if q.credits[i] == 0 {
+				continue
+			}
+			select {
+			case m := <-q.queues[i]:
+				q.credits[i]--
+				return m, true
+			default:
+			}
+		}
+
+		// Every queue with messages used up its credits, start a new round
+		q.credits = priorityWeights
+	}
+	return nil, false
+}
+
+// Signaled when a message was pushed, the writer should call Pop until it returns false after receiving from this
+func (q *SendQueue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Appends queued messages to batch until it holds max messages, waiting up to latency for more to arrive
+func (q *SendQueue) Fill(batch [][]byte, max int, latency time.Duration) [][]byte {
+	var flush <-chan time.Time
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		flush = timer.C
+	}
+
+	for len(batch) < max {
+		if m, ok := q.Pop(); ok {
+			batch = append(batch, m)
+			continue
+		}
+		if flush == nil {
+			return batch
+		}
+
+		select {
+		case <-q.notify:
+		case <-flush:
+			return batch
+		}
+	}
+	return batch
+}
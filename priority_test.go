@@ -0,0 +1,92 @@
+package fnet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func popAll(q *SendQueue) []byte {
+	popped := make([]byte, 0)
+	for {
+		m, ok := q.Pop()
+		if !ok {
+			return popped
+		}
+		popped = append(popped, m...)
+	}
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	q := NewSendQueue(8)
+	for _, m := range []struct {
+		b        byte
+		priority Priority
+	}{{'b', PriorityBulk}, {'n', PriorityNormal}, {'h', PriorityHigh}, {'c', PriorityControl}, {'x', Priority(10)}} {
+		if err := q.Push([]byte{m.b}, m.priority, time.Second, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unknown priorities are queued as PriorityNormal
+	if popped := popAll(q); string(popped) != "chnxb" {
+		t.Fatalf("got %q, expected %q", popped, "chnxb")
+	}
+}
+
+func TestSendQueueFairness(t *testing.T) {
+	q := NewSendQueue(32)
+	q.Push([]byte{'b'}, PriorityBulk, time.Second, nil)
+	for i := 0; i < 20; i++ {
+		q.Push([]byte{'c'}, PriorityControl, time.Second, nil)
+	}
+
+	// The bulk message gets its turn once the control queue used up its weight
+	expected := bytes.Repeat([]byte{'c'}, priorityWeights[PriorityControl])
+	expected = append(expected, 'b')
+	expected = append(expected, bytes.Repeat([]byte{'c'}, 20-priorityWeights[PriorityControl])...)
+	if popped := popAll(q); !bytes.Equal(popped, expected) {
+		t.Fatalf("got %q, expected %q", popped, expected)
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	q := NewSendQueue(1)
+	q.Push([]byte{0}, PriorityNormal, time.Second, nil)
+
+	if err := q.Push([]byte{1}, PriorityNormal, 10*time.Millisecond, nil); err != ErrSendTimeout {
+		t.Fatalf("got %v, expected ErrSendTimeout", err)
+	}
+	closed := make(chan struct{})
+	close(closed)
+	if err := q.Push([]byte{1}, PriorityNormal, time.Second, closed); err != ErrConnClosed {
+		t.Fatalf("got %v, expected ErrConnClosed", err)
+	}
+	// Other priorities have their own queue
+	if err := q.Push([]byte{1}, PriorityHigh, 10*time.Millisecond, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendQueueFill(t *testing.T) {
+	q := NewSendQueue(8)
+	for i := byte(0); i < 6; i++ {
+		q.Push([]byte{i}, PriorityNormal, time.Second, nil)
+	}
+
+	check := func(batch [][]byte, expected ...byte) {
+		t.Helper()
+		if !bytes.Equal(bytes.Join(batch, nil), expected) {
+			t.Fatalf("got batch %v, expected %v", batch, expected)
+		}
+	}
+	check(q.Fill([][]byte{{9}}, 4, 0), 9, 0, 1, 2)
+	// Whatever is queued is returned right away without a latency
+	check(q.Fill(nil, 4, 0), 3, 4, 5)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push([]byte{6}, PriorityNormal, time.Second, nil)
+	}()
+	check(q.Fill(nil, 4, 50*time.Millisecond), 6)
+}
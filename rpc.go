@@ -0,0 +1,292 @@
+package fnet
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Reserved event id's used for request/response messages
+// The payload of both is the request id followed by a complete wire message
+const (
+	EvtRequest  int32 = -1 // A request, the receiver sends back the handlers response
+	EvtResponse int32 = -2 // A response to a request
+)
+
+// Wraps an encoded wire message in a request or response message
+func (e *Engine) wrapMessage(envelope int32, reqId uint32, wireMessage []byte) ([]byte, error) {
+	payload := make([]byte, 4+len(wireMessage))
+	binary.LittleEndian.PutUint32(payload, reqId)
+	copy(payload[4:], wireMessage)
+	return e.createWireMessage(envelope, payload)
+}
+
+// Returns the request id, event id and payload from a request or response message payload
+func (e *Engine) unwrapMessage(payload []byte) (reqId uint32, evtId int32, inner []byte, err error) {
+	if len(payload) < 4 {
+		return 0, 0, nil, ErrMalformedMessage
+	}
+
+	reqId = binary.LittleEndian.Uint32(payload)
+	f, err := e.parseFrame(payload[4:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return reqId, f.evtId, f.payload, nil
+}
+
+// Creates a request wire message, the handler for evtId on the other end will respond with the same request id
+func (e *Engine) CreateRequestMessage(reqId uint32, evtId int32, data interface{}) ([]byte, error) {
+	inner, err := e.CreateWireMessage(evtId, data)
+	if err != nil {
+		return make([]byte, 0), err
+	}
+	return e.wrapMessage(EvtRequest, reqId, inner)
+}
+
+// Creates a response wire message to the request with reqId
+func (e *Engine) CreateResponseMessage(reqId uint32, evtId int32, data interface{}) ([]byte, error) {
+	inner, err := e.CreateWireMessage(evtId, data)
+	if err != nil {
+		return make([]byte, 0), err
+	}
+	return e.wrapMessage(EvtResponse, reqId, inner)
+}
+
+// Creates a request or response using the encoder negotiated with session
+func (e *Engine) createWrapped(session Session, envelope int32, reqId uint32, evtId int32, data interface{}) ([]byte, error) {
+	inner, err := e.createMessage(session, evtId, data)
+	if err != nil {
+		return make([]byte, 0), err
+	}
+	return e.wrapMessage(envelope, reqId, inner)
+}
+
+// Returns a new unique request id
+func (e *Engine) NextRequestId() uint32 {
+	id := atomic.AddUint32(e.lastRequestId, 1)
+	if id == 0 {
+		// 0 is never used, makes it easy to tell if a request id is set
+		id = atomic.AddUint32(e.lastRequestId, 1)
+	}
+	return id
+}
+
+// Sends a request, the response is passed to Engine.OnResponse with the returned request id
+func (e *Engine) SendRequest(session Session, evtId int32, data interface{}) (uint32, error) {
+	e.waitHandshake(session)
+	if !session.Supports(FeatureRequests) {
+		return 0, ErrNotSupported
+	}
+
+	reqId := e.NextRequestId()
+	wireMessage, err := e.createWrapped(session, EvtRequest, reqId, evtId, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return reqId, e.send(session, wireMessage)
+}
+
+// Calls the handler and sends back the response
+func (e *Engine) handleRequest(payload []byte, session Session) error {
+	reqId, evtId, inner, err := e.unwrapMessage(payload)
+	if err != nil {
+		return err
+	}
+	return e.callRequestHandler(&incomingRequest{id: reqId}, evtId, inner, session)
+}
+
+// Calls the handler for the request and sends back the response
+func (e *Engine) callRequestHandler(req *incomingRequest, evtId int32, payload []byte, session Session) error {
+	reqId := req.id
+	return e.callHandler(evtId, payload, session, req, func(resp interface{}, err error) error {
+		if err != nil {
+			if session.Supports(FeatureErrors) {
+				e.sendRequestError(session, reqId, evtId, err)
+			}
+			return err
+		}
+
+		wireMessage, err := e.createWrapped(session, EvtResponse, reqId, evtId, resp)
+		if err != nil {
+			return err
+		}
+		return e.send(session, wireMessage)
+	})
+}
+
+// Sends the error back in a response to the request
+func (e *Engine) sendRequestError(session Session, reqId uint32, evtId int32, handlerErr error) error {
+	errorMessage, err := e.createErrorMessage(toError(evtId, handlerErr))
+	if err != nil {
+		return err
+	}
+	wireMessage, err := e.wrapMessage(EvtResponse, reqId, errorMessage)
+	if err != nil {
+		return err
+	}
+	return e.send(session, wireMessage)
+}
+
+func (e *Engine) handleResponse(payload []byte, session Session) error {
+	reqId, evtId, inner, err := e.unwrapMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	call := e.takeCall(reqId, session)
+	if call != nil {
+		if evtId == EvtError {
+			// The request failed, the error is returned by Call
+			peerErr, err := parseError(inner)
+			if err != nil {
+				peerErr = &Error{Code: StatusUnknown, Message: err.Error()}
+			}
+			peerErr.Event = call.Event
+			call.finish(peerErr)
+			return nil
+		}
+		if call.Response != nil && len(inner) > 0 {
+			err = e.encoder(session).Unmarshal(inner, call.Response)
+		}
+		call.finish(err)
+		return nil
+	}
+
+	if e.OnResponse == nil {
+		return ErrNoHandlerFound
+	}
+	e.OnResponse(session, reqId, evtId, inner)
+	return nil
+}
+
+// Call represents a request waiting for a response
+type Call struct {
+	Event    int32       // The event id of the request
+	Request  interface{} // The request that was sent
+	Response interface{} // The response is decoded into this when it arrives
+	Error    error       // Set when the call is done, ErrTimeout if it timed out or a *Error if the peer returned one
+	Done     chan *Call  // Receives the call when it's done
+
+	session  Session
+	reqId    uint32
+	finished chan struct{}
+}
+
+// Sends a request and waits for the response, which is decoded into resp
+// Returns ErrTimeout if the context deadline is exceeded before the response arrives
+// If the peer supports it the deadline is sent along, and the request is cancelled on the peer when ctx is cancelled
+func (e *Engine) Call(ctx context.Context, session Session, evtId int32, req, resp interface{}) error {
+	call := <-e.Go(ctx, session, evtId, req, resp, nil).Done
+	return call.Error
+}
+
+// Sends a request without waiting for the response, the call is sent on done when it's finished
+// If done is nil a new channel is allocated, otherwise it has to be buffered with room for every call using it
+// Calls finishing while done is full are dropped, like with net/rpc
+func (e *Engine) Go(ctx context.Context, session Session, evtId int32, req, resp interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 1)
+	} else if cap(done) == 0 {
+		panic("fnet: Done channel is unbuffered")
+	}
+
+	call := &Call{
+		Event:    evtId,
+		Request:  req,
+		Response: resp,
+		Done:     done,
+		session:  session,
+		reqId:    e.NextRequestId(),
+		finished: make(chan struct{}),
+	}
+
+	e.waitHandshake(session)
+	if !session.Supports(FeatureRequests) {
+		call.finish(ErrNotSupported)
+		return call
+	}
+
+	wireMessage, err := e.createRequest(ctx, session, call.reqId, evtId, req)
+	if err != nil {
+		call.finish(err)
+		return call
+	}
+
+	e.pendingLock.Lock()
+	e.pendingCalls[call.reqId] = call
+	e.pendingLock.Unlock()
+
+	err = e.send(session, wireMessage)
+	if err != nil {
+		e.finishCall(call.reqId, err)
+		return call
+	}
+
+	// Started after sending so a cancel message is never queued before the request
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				e.finishCall(call.reqId, ErrTimeout)
+			} else if e.finishCall(call.reqId, ctx.Err()) {
+				// The peer knows the deadline, but not that the call was cancelled
+				e.sendCancel(session, call.reqId)
+			}
+		case <-call.finished:
+		}
+	}()
+	return call
+}
+
+// Removes the call from the pending calls and notifies the caller
+// Does nothing and returns false if the call is already finished
+func (e *Engine) finishCall(reqId uint32, err error) bool {
+	call := e.takeCall(reqId, Session{})
+	if call == nil {
+		return false
+	}
+	call.finish(err)
+	return true
+}
+
+// Removes and returns the pending call with reqId, if session is set the call also has to be made on it
+func (e *Engine) takeCall(reqId uint32, session Session) *Call {
+	e.pendingLock.Lock()
+	defer e.pendingLock.Unlock()
+
+	call, found := e.pendingCalls[reqId]
+	if !found || (session != Session{} && call.session != session) {
+		return nil
+	}
+	delete(e.pendingCalls, reqId)
+	return call
+}
+
+// Sends the call on Done without blocking, since it's called from the goroutine reading the session
+func (c *Call) finish(err error) {
+	c.Error = err
+	close(c.finished)
+	select {
+	case c.Done <- c:
+	default:
+		// Like net/rpc the call is dropped if Done is full
+	}
+}
+
+// Fails all pending calls made on session
+func (e *Engine) failCalls(session Session, err error) {
+	e.pendingLock.Lock()
+	ids := make([]uint32, 0)
+	for id, call := range e.pendingCalls {
+		if call.session == session {
+			ids = append(ids, id)
+		}
+	}
+	e.pendingLock.Unlock()
+
+	for _, id := range ids {
+		e.finishCall(id, err)
+	}
+}
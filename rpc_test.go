@@ -0,0 +1,159 @@
+package fnet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type response struct {
+	reqId uint32
+	evtId int32
+	msg   testMsg
+}
+
+func TestRequestResponse(t *testing.T) {
+	srv, cli := newEngines()
+	srv.AddHandler(NewHandlerSafe(func(session Session, req testMsg) (*testMsg, error) {
+		if req.Text == "fail" {
+			return nil, errors.New("Failed")
+		}
+		return &testMsg{Text: req.Text + "!"}, nil
+	}, 1))
+	responses := make(chan response, 3)
+	cli.OnResponse = func(session Session, reqId uint32, evtId int32, payload []byte) {
+		resp := response{reqId: reqId, evtId: evtId}
+		if evtId == EvtError {
+			peerErr, err := parseError(payload)
+			if err != nil {
+				t.Error(err)
+			} else {
+				resp.msg.Text = peerErr.Message
+			}
+		} else if err := cli.Encoder.Unmarshal(payload, &resp.msg); err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}
+	_, cs := connect(t, srv, cli)
+
+	first, err := cli.SendRequest(cs, 1, testMsg{Text: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Failed requests get the error back
+	failed, err := cli.SendRequest(cs, 1, testMsg{Text: "fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cli.SendRequest(cs, 1, testMsg{Text: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("request ids aren't unique")
+	}
+
+	for _, expected := range []response{{first, 1, testMsg{"a!"}}, {failed, EvtError, testMsg{"Failed"}}, {second, 1, testMsg{"b!"}}} {
+		if resp := receive(t, responses); resp != expected {
+			t.Fatalf("got %+v, expected %+v", resp, expected)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	srv, cli := newEngines()
+	srv.AddHandler(NewHandlerSafe(func(session Session, req testMsg) (*testMsg, error) {
+		return &testMsg{Text: req.Text + "!"}, nil
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var resp testMsg
+	if err := cli.Call(ctx, cs, 1, testMsg{Text: "a"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "a!" {
+		t.Fatal(resp.Text)
+	}
+
+	// Both calls are sent before waiting for either
+	done := make(chan *Call, 2)
+	first := cli.Go(ctx, cs, 1, testMsg{Text: "b"}, new(testMsg), done)
+	second := cli.Go(ctx, cs, 1, testMsg{Text: "c"}, new(testMsg), done)
+	for i := 0; i < 2; i++ {
+		call := receive(t, done)
+		if call != first && call != second {
+			t.Fatal("unknown call")
+		}
+		if call.Error != nil || call.Response.(*testMsg).Text != call.Request.(testMsg).Text+"!" {
+			t.Fatal(call.Error, call.Response)
+		}
+	}
+}
+
+func TestCallDoneFull(t *testing.T) {
+	srv, cli := newEngines()
+	srv.AddHandler(NewHandlerSafe(func(session Session, req testMsg) (*testMsg, error) {
+		return &testMsg{Text: req.Text}, nil
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	// Only room for one of them, the other is dropped instead of blocking the connection
+	done := make(chan *Call, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cli.Go(ctx, cs, 1, testMsg{Text: "a"}, new(testMsg), done)
+	cli.Go(ctx, cs, 1, testMsg{Text: "b"}, new(testMsg), done)
+
+	var resp testMsg
+	if err := cli.Call(ctx, cs, 1, testMsg{Text: "c"}, &resp); err != nil || resp.Text != "c" {
+		t.Fatal(err, resp.Text)
+	}
+	if call := receive(t, done); call.Error != nil {
+		t.Fatal(call.Error)
+	}
+	if len(done) != 0 {
+		t.Fatal("more calls than done has room for")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	srv, cli := newEngines()
+	release := make(chan struct{})
+	defer close(release)
+	srv.AddHandler(NewHandlerSafe(func(session Session, req testMsg) (*testMsg, error) {
+		<-release
+		return &testMsg{}, nil
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cli.Call(ctx, cs, 1, testMsg{}, new(testMsg)); err != ErrTimeout {
+		t.Fatalf("got %v, expected ErrTimeout", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	call := cli.Go(ctx, cs, 1, testMsg{}, new(testMsg), nil)
+	cancel()
+	if call := receive(t, call.Done); call.Error != context.Canceled {
+		t.Fatalf("got %v, expected context.Canceled", call.Error)
+	}
+}
+
+func TestCallConnClosed(t *testing.T) {
+	srv, cli := newEngines()
+	srv.AddHandler(NewHandlerSafe(func(session Session, req testMsg) (*testMsg, error) {
+		session.Conn.Close()
+		return nil, nil
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	call := cli.Go(context.Background(), cs, 1, testMsg{}, new(testMsg), nil)
+	if call := receive(t, call.Done); call.Error != ErrConnClosed {
+		t.Fatalf("got %v, expected ErrConnClosed", call.Error)
+	}
+}
@@ -0,0 +1,142 @@
+package fnet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Reserved event id for errors sent back to the peer when handling one of its messages failed
+// The payload is the event id of the message as a little endian int32, the StatusCode as a little endian uint16 and the message
+// Errors for requests are sent wrapped in a response instead
+const EvtError int32 = -12
+
+// Tells the peer why handling its message failed, the values are the same as the grpc status codes
+type StatusCode uint16
+
+const (
+	StatusUnknown            StatusCode = 2 // Handlers returned an error that isn't a *Error
+	StatusInvalidArgument    StatusCode = 3 // The message couldn't be decoded
+	StatusDeadlineExceeded   StatusCode = 4
+	StatusNotFound           StatusCode = 5
+	StatusPermissionDenied   StatusCode = 7
+	StatusResourceExhausted  StatusCode = 8 // The message was too large, or its stream handler busy
+	StatusFailedPrecondition StatusCode = 9
+	StatusUnimplemented      StatusCode = 12 // There's no handler for the event
+	StatusInternal           StatusCode = 13
+	StatusUnavailable        StatusCode = 14
+	StatusUnauthenticated    StatusCode = 16
+)
+
+var statusCodeNames = map[StatusCode]string{
+	StatusUnknown:            "unknown",
+	StatusInvalidArgument:    "invalid argument",
+	StatusDeadlineExceeded:   "deadline exceeded",
+	StatusNotFound:           "not found",
+	StatusPermissionDenied:   "permission denied",
+	StatusResourceExhausted:  "resource exhausted",
+	StatusFailedPrecondition: "failed precondition",
+	StatusUnimplemented:      "unimplemented",
+	StatusInternal:           "internal",
+	StatusUnavailable:        "unavailable",
+	StatusUnauthenticated:    "unauthenticated",
+}
+
+func (s StatusCode) String() string {
+	if name, ok := statusCodeNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("StatusCode(%d)", uint16(s))
+}
+
+// An error with a status code, sent to the peer when a handler returns it
+// Call returns this when the peer responded to the request with an error
+type Error struct {
+	Code    StatusCode
+	Message string
+	Event   int32 // The event id of the message that failed, set on errors received from the peer
+}
+
+// Creates a *Error, for handlers to return
+func Errorf(code StatusCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Converts an error returned while handling a message for evtId into a *Error
+func toError(evtId int32, err error) *Error {
+	if handlerErr, ok := err.(*HandlerError); ok {
+		err = handlerErr.Err
+	}
+
+	switch t := err.(type) {
+	case *Error:
+		return &Error{Code: t.Code, Message: t.Message, Event: evtId}
+	case *PanicError:
+		// The panic value could contain anything, so it's not sent to the peer
+		return &Error{Code: StatusInternal, Message: "Internal error", Event: evtId}
+	}
+
+	switch err {
+	case ErrNoHandlerFound:
+		return &Error{Code: StatusUnimplemented, Message: err.Error(), Event: evtId}
+	case ErrPayloadTooLarge, ErrHandlerBusy:
+		return &Error{Code: StatusResourceExhausted, Message: err.Error(), Event: evtId}
+	}
+	return &Error{Code: StatusUnknown, Message: err.Error(), Event: evtId}
+}
+
+// Returned when decoding a message failed
+func decodeError(err error) *Error {
+	return &Error{Code: StatusInvalidArgument, Message: err.Error()}
+}
+
+// Creates an error wire message
+func (e *Engine) createErrorMessage(err *Error) ([]byte, error) {
+	payload := make([]byte, 6, 6+len(err.Message))
+	binary.LittleEndian.PutUint32(payload, uint32(err.Event))
+	binary.LittleEndian.PutUint16(payload[4:], uint16(err.Code))
+	payload = append(payload, err.Message...)
+	return e.createWireMessage(EvtError, payload)
+}
+
+func parseError(payload []byte) (*Error, error) {
+	if len(payload) < 6 {
+		return nil, ErrMalformedMessage
+	}
+	return &Error{
+		Event:   int32(binary.LittleEndian.Uint32(payload)),
+		Code:    StatusCode(binary.LittleEndian.Uint16(payload[4:])),
+		Message: string(payload[6:]),
+	}, nil
+}
+
+// Tells the peer that handling its message for evtId failed with err
+func (e *Engine) sendError(session Session, evtId int32, handlerErr error) error {
+	if !session.Supports(FeatureErrors) {
+		return nil
+	}
+
+	wireMessage, err := e.createErrorMessage(toError(evtId, handlerErr))
+	if err != nil {
+		return err
+	}
+	return e.send(session, wireMessage)
+}
+
+// Handles an error the peer sent about one of our messages
+func (e *Engine) handleError(payload []byte, session Session) error {
+	peerErr, err := parseError(payload)
+	if err != nil {
+		return err
+	}
+
+	if e.OnPeerError != nil {
+		e.OnPeerError(session, peerErr)
+	} else {
+		fmt.Printf("Handling event %d failed on the peer: %s\n", peerErr.Event, peerErr)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package fnet
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPeerError(t *testing.T) {
+	srv, cli := newEngines()
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) (*testMsg, error) {
+		if msg.Text == "deny" {
+			return nil, Errorf(StatusPermissionDenied, "no %s", "access")
+		}
+		return nil, errors.New("Boom")
+	}, 1))
+	peerErrors := make(chan Error, 4)
+	cli.OnPeerError = func(session Session, err *Error) {
+		peerErrors <- *err
+	}
+	_, cs := connect(t, srv, cli)
+
+	cli.CreateAndSend(cs, 1, testMsg{Text: "deny"})
+	cli.CreateAndSend(cs, 1, testMsg{Text: "other"})
+	// No handler for the event
+	cli.CreateAndSend(cs, 2, testMsg{})
+	// Can't be decoded
+	invalid, _ := cli.createWireMessage(1, []byte("{"))
+	cs.Conn.Send(invalid)
+
+	for _, expected := range []Error{
+		{Code: StatusPermissionDenied, Message: "no access", Event: 1},
+		{Code: StatusUnknown, Message: "Boom", Event: 1},
+		{Code: StatusUnimplemented, Message: ErrNoHandlerFound.Error(), Event: 2},
+	} {
+		if err := receive(t, peerErrors); err != expected {
+			t.Fatalf("got %+v, expected %+v", err, expected)
+		}
+	}
+	if err := receive(t, peerErrors); err.Code != StatusInvalidArgument || err.Event != 1 {
+		t.Fatalf("got %+v, expected an invalid argument error", err)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	srv, cli := newEngines()
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) (*testMsg, error) {
+		return nil, Errorf(StatusNotFound, "no %q", msg.Text)
+	}, 3))
+	_, cs := connect(t, srv, cli)
+
+	err := cli.Call(context.Background(), cs, 3, testMsg{Text: "x"}, new(testMsg))
+	peerErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %v, expected a *Error", err)
+	}
+	if *peerErr != (Error{Code: StatusNotFound, Message: `no "x"`, Event: 3}) {
+		t.Fatalf("got %+v", *peerErr)
+	}
+	if peerErr.Error() != `not found: no "x"` {
+		t.Fatalf("got %q", peerErr.Error())
+	}
+}
@@ -0,0 +1,60 @@
+package fnet
+
+// Event id's below 0 are reserved for control messages used by the engine itself
+// They're handled internally before the handlers are looked up and AddHandler refuses to register them
+//
+//	-1  EvtRequest         A request wrapping another message
+//	-2  EvtResponse        A response to a request
+//	-3  EvtHello           Handshake hello
+//	-4  EvtAccept          Handshake accepted
+//	-5  EvtReject          Handshake rejected
+//	-6  EvtCompressed      A compressed message
+//	-7  EvtChecksum        A message with a crc32 checksum
+//	-8  EvtFragment        A fragment of a message
+//	-9  EvtPing            Heartbeat ping
+//	-10 EvtPong            Heartbeat pong
+//	-11 EvtClose           The peer is closing the session
+//	-12 EvtError           Handling a message failed
+//	-13 EvtCancel          Cancels a request
+//	-14 EvtDeadlineRequest A request with a deadline
+const MaxReservedEvent int32 = -1
+
+// Returns wether evt is in the reserved range
+func IsReservedEvent(evt int32) bool {
+	return evt <= MaxReservedEvent
+}
+
+// Handles a control message
+type systemHandler func(e *Engine, payload []byte, session Session) error
+
+// The handlers for the reserved event id's, checked before Engine.handlers
+// Reserved id's not in here are treated like events without a handler, they may be used by newer versions
+var systemHandlers map[int32]systemHandler
+
+func init() {
+	systemHandlers = map[int32]systemHandler{
+		EvtRequest:         (*Engine).handleRequest,
+		EvtResponse:        (*Engine).handleResponse,
+		EvtCompressed:      (*Engine).handleCompressed,
+		EvtFragment:        (*Engine).handleFragment,
+		EvtPing:            (*Engine).handlePing,
+		EvtPong:            (*Engine).handlePong,
+		EvtClose:           (*Engine).handleClose,
+		EvtError:           (*Engine).handleError,
+		EvtCancel:          (*Engine).handleCancel,
+		EvtDeadlineRequest: (*Engine).handleDeadlineRequest,
+		EvtHello:           unexpectedHello,
+		EvtAccept:          unexpectedHello,
+		EvtReject: func(e *Engine, payload []byte, session Session) error {
+			return rejectError(payload)
+		},
+	}
+}
+
+// Engines without a Handshake ignore the hello of peers that have one, those then treat them as old peers
+func unexpectedHello(e *Engine, payload []byte, session Session) error {
+	if e.Handshake == nil {
+		return nil
+	}
+	return ErrUnexpectedHello
+}
@@ -0,0 +1,44 @@
+package fnet
+
+import (
+	"testing"
+)
+
+func TestAddReservedHandler(t *testing.T) {
+	e, _ := newEngines()
+	callback := func(session Session, msg testMsg) {}
+
+	for _, evt := range []int32{MaxReservedEvent, EvtRequest, EvtPing, -1000} {
+		if err := e.AddHandler(NewHandlerSafe(callback, evt)); err != ErrReservedEvent {
+			t.Fatalf("event %d: got %v, expected ErrReservedEvent", evt, err)
+		}
+	}
+	if err := e.AddHandlers(NewHandlerSafe(callback, 0), NewHandlerSafe(callback, -5)); err != ErrReservedEvent {
+		t.Fatalf("got %v, expected ErrReservedEvent", err)
+	}
+	if _, found := e.handlers[0]; !found {
+		t.Fatal("handler before the reserved one wasn't added")
+	}
+}
+
+func TestUnknownReservedEvent(t *testing.T) {
+	srv, cli := newEngines()
+	received := make(chan testMsg, 1)
+	srv.AddHandler(NewHandlerSafe(func(session Session, msg testMsg) {
+		received <- msg
+	}, 1))
+	_, cs := connect(t, srv, cli)
+
+	// Reserved id's without a system handler may be used by newer versions, they're not a reason to disconnect
+	unknown, err := cli.createWireMessage(-1000, []byte("newer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Conn.Send(unknown)
+	if err := cli.CreateAndSend(cs, 1, testMsg{Text: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, received); msg.Text != "a" {
+		t.Fatalf("got %q, expected %q", msg.Text, "a")
+	}
+}
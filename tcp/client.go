@@ -12,10 +12,7 @@ func Dial(addr string) (fnet.Session, error) {
 	}
 
 	wrappedConn := NewTCPConn(nativeConn)
-	session := fnet.Session{
-		Conn: wrappedConn,
-		Data: new(fnet.SessionStore),
-	}
+	session := fnet.NewSession(wrappedConn)
 
 	return session, nil
 }
@@ -4,6 +4,7 @@ import (
 	"github.com/jonas747/fnet"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -12,6 +13,10 @@ type TCPListner struct {
 	Addr      string
 	Listening bool
 	StopChan  chan chan bool
+
+	// Write batching settings for accepted connections, see TCPConn
+	MaxBatch     int
+	FlushLatency time.Duration
 }
 
 // Implements fnet.Listener.Listen
@@ -42,10 +47,11 @@ func (t *TCPListner) Listen() error {
 			return err
 		}
 		wrappedConn := NewTCPConn(conn)
-		session := fnet.Session{
-			Conn: wrappedConn,
-			Data: new(fnet.SessionStore),
+		if t.MaxBatch > 0 {
+			wrappedConn.(*TCPConn).MaxBatch = t.MaxBatch
 		}
+		wrappedConn.(*TCPConn).FlushLatency = t.FlushLatency
+		session := fnet.NewSession(wrappedConn)
 		go t.Engine.HandleConn(session)
 	}
 }
@@ -65,41 +71,73 @@ func (t *TCPListner) Stop() error {
 	return nil
 }
 
+// Number of messages written at once by default
+const DefaultMaxBatch = 64
+
 type TCPConn struct {
 	sessionStore *fnet.SessionStore
 	conn         net.Conn
 
-	writeChan   chan []byte
-	stopWriting chan bool
-	writing     bool
+	// Max number of queued messages written with a single call, has to be set before Run
+	MaxBatch int
+	// How long the writer waits for more messages before writing a batch, 0 to write whatever is queued right away
+	FlushLatency time.Duration
+
+	queue     *fnet.SendQueue
+	flushChan chan chan struct{}
 
-	isOpen bool
+	closed    chan struct{} // Closed when the connection is closed, stops the writer
+	closeOnce sync.Once
+	errLock   sync.Mutex
+	err       error // Why the connection closed itself
 }
 
 func NewTCPConn(c net.Conn) fnet.Connection {
-	store := &fnet.SessionStore{make(map[string]interface{})}
+	store := &fnet.SessionStore{
+		Data: make(map[string]interface{}),
+	}
 	conn := TCPConn{
 		sessionStore: store,
 		conn:         c,
-		writeChan:    make(chan []byte),
-		stopWriting:  make(chan bool),
-		isOpen:       true,
+		queue:        fnet.NewSendQueue(DefaultMaxBatch),
+		flushChan:    make(chan chan struct{}),
+		closed:       make(chan struct{}),
+		MaxBatch:     DefaultMaxBatch,
 	}
 	return &conn
 }
 
 // Implements Connection.Send([]byte)
 func (t *TCPConn) Send(b []byte) error {
-	if !t.isOpen {
+	return t.SendPriority(b, fnet.PriorityNormal)
+}
+
+// Implements fnet.PrioritySender
+func (t *TCPConn) SendPriority(b []byte, priority fnet.Priority) error {
+	if !t.Open() {
 		return fnet.ErrConnClosed
 	}
-	after := time.After(time.Duration(5) * time.Second) // Time out
+	err := t.queue.Push(b, priority, time.Duration(5)*time.Second, t.closed)
+	if err == fnet.ErrSendTimeout {
+		t.fail(err)
+	}
+	return err
+}
+
+// Implements fnet.Flusher, blocks until the messages queued before the call are written
+func (t *TCPConn) Flush() error {
+	done := make(chan struct{})
 	select {
-	case t.writeChan <- b:
+	case t.flushChan <- done:
+	case <-t.closed:
+		return fnet.ErrConnClosed
+	}
+
+	select {
+	case <-done:
 		return nil
-	case <-after:
-		t.Close()
-		return fnet.ErrTimeout
+	case <-t.closed:
+		return fnet.ErrConnClosed
 	}
 }
 
@@ -115,17 +153,40 @@ func (t *TCPConn) Kind() string {
 
 // Implements Connection.Close()
 func (t *TCPConn) Close() {
-	if t.isOpen {
-		t.isOpen = false
+	t.fail(nil)
+}
+
+// Closes the connection, err is reported by CloseError if it wasn't closed already
+func (t *TCPConn) fail(err error) {
+	t.closeOnce.Do(func() {
+		t.errLock.Lock()
+		t.err = err
+		t.errLock.Unlock()
+
+		close(t.closed)
 		t.conn.Close()
-	}
-	if t.writing {
-		t.stopWriting <- true
-	}
+	})
+}
+
+// Implements fnet.CloseReporter
+func (t *TCPConn) CloseError() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	return t.err
 }
 
 func (t *TCPConn) Open() bool {
-	return t.isOpen
+	select {
+	case <-t.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+func (t *TCPConn) IP() string {
+	host, _, _ := net.SplitHostPort(t.conn.RemoteAddr().String())
+	return host
 }
 
 func (t *TCPConn) GetSessionData() *fnet.SessionStore {
@@ -139,19 +200,42 @@ func (t *TCPConn) Run() {
 }
 
 func (t *TCPConn) writer() {
-	t.writing = true
-	defer func() {
-		t.writing = false
-	}()
+	batch := make(net.Buffers, 0, t.MaxBatch)
 	for {
-		select {
-		case m := <-t.writeChan:
-			_, err := t.conn.Write(m)
+		if m, ok := t.queue.Pop(); ok {
+			err := t.write(t.queue.Fill(append(batch[:0], m), t.MaxBatch, t.FlushLatency))
 			if err != nil {
-				break
+				return
 			}
-		case <-t.stopWriting:
+			continue
+		}
+
+		select {
+		case <-t.queue.Notify():
+		case done := <-t.flushChan:
+			// Everything sent before Flush was called is queued by now
+			for {
+				m, ok := t.queue.Pop()
+				if !ok {
+					break
+				}
+				err := t.write(t.queue.Fill(append(batch[:0], m), t.MaxBatch, 0))
+				if err != nil {
+					return
+				}
+			}
+			close(done)
+		case <-t.closed:
 			return
 		}
 	}
 }
+
+// Writes a batch with a single writev syscall, closing the connection if that fails
+func (t *TCPConn) write(batch net.Buffers) error {
+	_, err := batch.WriteTo(t.conn)
+	if err != nil {
+		t.fail(&fnet.WriteError{Err: err})
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package tcp
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jonas747/fnet"
+)
+
+func TestWritePriority(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := NewTCPConn(a).(*TCPConn)
+	defer conn.Close()
+
+	// Queued before the writer starts, so they're all written in one batch
+	conn.SendPriority([]byte{'b'}, fnet.PriorityBulk)
+	conn.Send([]byte{'n'})
+	conn.SendPriority([]byte{'c'}, fnet.PriorityControl)
+	conn.Run()
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "cnb" {
+		t.Fatalf("got %q, expected %q", buf, "cnb")
+	}
+
+	// Flush waits for the queued messages to be written
+	conn.Send([]byte{'f'})
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- conn.Flush()
+	}()
+	if _, err := io.ReadFull(b, buf[:1]); err != nil || buf[0] != 'f' {
+		t.Fatalf("got %q %v, expected %q", buf[0], err, 'f')
+	}
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,10 +13,7 @@ func Dial(addr, protocol, origin string) (fnet.Session, error) {
 
 	wrappedConn := NewWebsocketConn(nativeConn)
 
-	session := fnet.Session{
-		Conn: wrappedConn,
-		Data: new(fnet.SessionStore),
-	}
+	session := fnet.NewSession(wrappedConn)
 
 	return session, nil
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/jonas747/fnet"
 	"golang.org/x/net/websocket"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
@@ -14,16 +15,22 @@ type WebsocketListener struct {
 	Engine    *fnet.Engine
 	Addr      string
 	Listening bool
+
+	// Write batching settings for accepted connections, see WebsocketConn
+	// Batching is off unless MaxBatch is above 1, only enable it if all clients are fnet peers
+	MaxBatch     int
+	FlushLatency time.Duration
 }
 
 // Implements fnet.Listener.Listen
 func (w *WebsocketListener) Listen() error {
 	handler := func(ws *websocket.Conn) {
 		conn := NewWebsocketConn(ws)
-		session := fnet.Session{
-			Conn: conn,
-			Data: new(fnet.SessionStore),
+		if w.MaxBatch > 0 {
+			conn.(*WebsocketConn).MaxBatch = w.MaxBatch
 		}
+		conn.(*WebsocketConn).FlushLatency = w.FlushLatency
+		session := fnet.NewSession(conn)
 		w.Engine.HandleConn(session)
 	}
 
@@ -49,15 +56,30 @@ func (w *WebsocketListener) Stop() error {
 	return nil
 }
 
+// Number of messages sent in a single websocket frame by default
+// Clients like browsers expect one message per websocket message, so batching is opt-in
+const DefaultMaxBatch = 1
+
+// Number of messages queued per priority
+const queueSize = 64
+
 type WebsocketConn struct {
 	sessionStore *fnet.SessionStore
 	conn         *websocket.Conn
 
-	writeChan   chan []byte
-	stopWriting chan bool
-	writing     bool
+	// Max number of queued messages sent in a single websocket frame, has to be set before Run
+	// With more than 1 the peer has to split websocket messages into fnet messages by their headers
+	MaxBatch int
+	// How long the writer waits for more messages before sending a frame, 0 to send whatever is queued right away
+	FlushLatency time.Duration
+
+	queue     *fnet.SendQueue
+	flushChan chan chan struct{}
+
+	closed    chan struct{} // Closed when the connection is closed, stops the writer
+	closeOnce sync.Once
 	sync.Mutex
-	isOpen bool
+	err error // Why the connection closed itself
 }
 
 func NewWebsocketConn(c *websocket.Conn) fnet.Connection {
@@ -67,34 +89,55 @@ func NewWebsocketConn(c *websocket.Conn) fnet.Connection {
 	conn := WebsocketConn{
 		sessionStore: store,
 		conn:         c,
-		writeChan:    make(chan []byte),
-		stopWriting:  make(chan bool),
-		isOpen:       true,
+		queue:        fnet.NewSendQueue(queueSize),
+		flushChan:    make(chan chan struct{}),
+		closed:       make(chan struct{}),
+		MaxBatch:     DefaultMaxBatch,
 	}
 	return &conn
 }
 
 // Implements Connection.Send([]byte)
 func (w *WebsocketConn) Send(b []byte) error {
-	if !w.isOpen {
+	return w.SendPriority(b, fnet.PriorityNormal)
+}
+
+// Implements fnet.PrioritySender
+func (w *WebsocketConn) SendPriority(b []byte, priority fnet.Priority) error {
+	if !w.Open() {
 		return errors.New("Cannot call WebsocketConn.Send() on a closed connection")
 	}
-	after := time.After(time.Duration(60) * time.Second) // Time out
+	err := w.queue.Push(b, priority, time.Duration(60)*time.Second, w.closed)
+	if err == fnet.ErrSendTimeout {
+		w.fail(err)
+	}
+	return err
+}
+
+// Implements fnet.Flusher, blocks until the messages queued before the call are written
+func (w *WebsocketConn) Flush() error {
+	done := make(chan struct{})
 	select {
-	case w.writeChan <- b:
+	case w.flushChan <- done:
+	case <-w.closed:
+		return fnet.ErrConnClosed
+	}
+
+	select {
+	case <-done:
 		return nil
-	case <-after:
-		w.Close()
-		return errors.New("Timed out sending payload to writechan")
+	case <-w.closed:
+		return fnet.ErrConnClosed
 	}
 }
 
 func (w *WebsocketConn) Read(buf []byte) error {
-	if !w.isOpen {
+	if !w.Open() {
 		return errors.New("Can't read from closed connection")
 	}
 
-	_, err := w.conn.Read(buf)
+	// Messages can be split over multiple frames
+	_, err := io.ReadFull(w.conn, buf)
 	return err
 }
 
@@ -105,22 +148,35 @@ func (w *WebsocketConn) Kind() string {
 
 // Implements Connection.Close()
 func (w *WebsocketConn) Close() {
-	if w.isOpen {
-		w.isOpen = false
+	w.fail(nil)
+}
+
+// Closes the connection, err is reported by CloseError if it wasn't closed already
+func (w *WebsocketConn) fail(err error) {
+	w.closeOnce.Do(func() {
+		w.Lock()
+		w.err = err
+		w.Unlock()
+
+		close(w.closed)
 		w.conn.Close()
-	}
+	})
+}
+
+// Implements fnet.CloseReporter
+func (w *WebsocketConn) CloseError() error {
 	w.Lock()
-	if w.writing {
-		w.writing = false
-		w.Unlock()
-		w.stopWriting <- true
-	} else {
-		w.Unlock()
-	}
+	defer w.Unlock()
+	return w.err
 }
 
 func (w *WebsocketConn) Open() bool {
-	return w.isOpen
+	select {
+	case <-w.closed:
+		return false
+	default:
+		return true
+	}
 }
 
 func (w *WebsocketConn) GetSessionData() *fnet.SessionStore {
@@ -135,26 +191,63 @@ func (w *WebsocketConn) Run() {
 
 // Writes messages from WebsocketConn.writeChan, Which is used by WebsocketConn.Write([]byte)
 func (w *WebsocketConn) writer() {
-	w.writing = true
-	defer func() {
-		w.Lock()
-		w.writing = false
-		w.Unlock()
-		//close(w.stopWriting)
-	}()
+	batch := make([][]byte, 0, w.MaxBatch)
 	for {
-		select {
-		case m := <-w.writeChan:
-			err := websocket.Message.Send(w.conn, m)
+		if m, ok := w.queue.Pop(); ok {
+			err := w.write(w.queue.Fill(append(batch[:0], m), w.MaxBatch, w.FlushLatency))
 			if err != nil {
 				return
 			}
-		case <-w.stopWriting:
+			continue
+		}
+
+		select {
+		case <-w.queue.Notify():
+		case done := <-w.flushChan:
+			// Everything sent before Flush was called is queued by now
+			for {
+				m, ok := w.queue.Pop()
+				if !ok {
+					break
+				}
+				err := w.write(w.queue.Fill(append(batch[:0], m), w.MaxBatch, 0))
+				if err != nil {
+					return
+				}
+			}
+			close(done)
+		case <-w.closed:
 			return
 		}
 	}
 }
 
+// Sends a batch in a single websocket frame, closing the connection if that fails
+func (w *WebsocketConn) write(batch [][]byte) error {
+	err := websocket.Message.Send(w.conn, joinBatch(batch))
+	if err != nil {
+		w.fail(&fnet.WriteError{Err: err})
+	}
+	return err
+}
+
+// Joins the messages in a batch so they can be sent in a single frame
+func joinBatch(batch [][]byte) []byte {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+
+	size := 0
+	for _, m := range batch {
+		size += len(m)
+	}
+	joined := make([]byte, 0, size)
+	for _, m := range batch {
+		joined = append(joined, m...)
+	}
+	return joined
+}
+
 func (w *WebsocketConn) IP() string {
 	addr := w.conn.Request().RemoteAddr
 	split := strings.Split(addr, ":")
@@ -0,0 +1,18 @@
+package ws
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestJoinBatch(t *testing.T) {
+	single := []byte("single")
+	if joined := joinBatch([][]byte{single}); &joined[0] != &single[0] {
+		t.Fatal("a batch with a single message was copied")
+	}
+
+	joined := joinBatch([][]byte{[]byte("a"), nil, []byte("bc")})
+	if !bytes.Equal(joined, []byte("abc")) {
+		t.Fatalf("got %q", joined)
+	}
+}